@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// defaultArgMax is the limit on arguments and environment we assume when we
+// can not find out the system's. Every system rgp runs on allows at least
+// 128KiB.
+const defaultArgMax = 128 << 10
+
+// maxArgBytes is how many bytes of arguments and environment we pass to a
+// command. A single argument is also limited to 128KiB on Linux, which a
+// path never reaches.
+var maxArgBytes = argMax()
+
+// argBytes is how much of the argument limit s uses. Besides the string and
+// its NUL terminator, the kernel counts the 8 byte pointer to it.
+func argBytes(s string) int {
+	return len(s) + 1 + 8
+}
+
+// wholeRunFlag returns the first of args which affects the output of a
+// whole ripgrep run, rather than each file, such as --sort and --stats.
+// Splitting the paths of such a run changes its output.
+func wholeRunFlag(args []string) (string, bool) {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "--sort") || arg == "--stats" {
+			return arg, true
+		}
+	}
+	return "", false
+}
+
+// batchPaths splits paths into batches which can be passed to a command
+// after args without exceeding maxArgBytes. There is always at least one
+// batch, so a command without paths is still run once. Paths are not split
+// if args contain a wholeRunFlag.
+func batchPaths(args, paths []string) [][]string {
+	if _, ok := wholeRunFlag(args); ok {
+		return [][]string{paths}
+	}
+
+	size := 0
+	for _, kv := range os.Environ() {
+		size += argBytes(kv)
+	}
+	for _, arg := range args {
+		size += argBytes(arg)
+	}
+	// Leave room for the program name and what the runtime adds.
+	size += 4 << 10
+
+	var (
+		batches [][]string
+		batch   []string
+		n       = size
+	)
+	for _, p := range paths {
+		if len(batch) > 0 && n+argBytes(p) > maxArgBytes {
+			batches = append(batches, batch)
+			batch, n = nil, size
+		}
+		batch = append(batch, p)
+		n += argBytes(p)
+	}
+	return append(batches, batch)
+}
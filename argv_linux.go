@@ -0,0 +1,21 @@
+package main
+
+import "syscall"
+
+// argMax returns the limit Linux puts on the arguments and environment of a
+// command: a quarter of the stack size limit, but at most 6MiB and at least
+// 128KiB.
+func argMax() int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_STACK, &lim); err != nil {
+		return defaultArgMax
+	}
+	n := uint64(6 << 20)
+	if lim.Cur/4 < n {
+		n = lim.Cur / 4
+	}
+	if n < defaultArgMax {
+		return defaultArgMax
+	}
+	return int(n)
+}
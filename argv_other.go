@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// argMax returns defaultArgMax, since other systems do not make it easy to
+// find their limit. Commands which are still too long are split when they
+// fail.
+func argMax() int {
+	return defaultArgMax
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBatchPaths(t *testing.T) {
+	if got := batchPaths([]string{"--files"}, nil); len(got) != 1 || len(got[0]) != 0 {
+		t.Errorf("batchPaths without paths == %q, want one empty batch", got)
+	}
+
+	args := []string{"-i", "-e", "foo"}
+	var paths []string
+	for i := 0; i < 200000; i++ {
+		paths = append(paths, fmt.Sprintf("/home/user/src/github.com/acme/repo%d", i))
+	}
+	batches := batchPaths(args, paths)
+	if len(batches) < 2 {
+		t.Fatalf("expected %d paths to be split, got %d batch", len(paths), len(batches))
+	}
+	env := 0
+	for _, kv := range os.Environ() {
+		env += argBytes(kv)
+	}
+	var all []string
+	for _, batch := range batches {
+		n := env
+		for _, arg := range concat([]string{"rg"}, args, batch) {
+			n += argBytes(arg)
+		}
+		if n > maxArgBytes {
+			t.Errorf("batch of %d paths uses %d bytes, more than %d", len(batch), n, maxArgBytes)
+		}
+		all = append(all, batch...)
+	}
+	if !reflect.DeepEqual(all, paths) {
+		t.Error("batches do not contain the paths in order")
+	}
+}
+
+func TestBatchPathsWholeRun(t *testing.T) {
+	var paths []string
+	for i := 0; i < 200000; i++ {
+		paths = append(paths, fmt.Sprintf("/home/user/src/github.com/acme/repo%d", i))
+	}
+	for _, args := range [][]string{{"--sort", "path", "-e", "foo"}, {"--sortr=modified", "-e", "foo"}, {"--stats", "-e", "foo"}} {
+		if got := batchPaths(args, paths); len(got) != 1 {
+			t.Errorf("batchPaths(%q) split paths into %d batches", args, len(got))
+		}
+	}
+	if got := batchPaths([]string{"-e", "foo", "--", "--stats"}, paths); len(got) < 2 {
+		t.Errorf("a pattern after -- should not stop batching")
+	}
+}
+
+func TestArgMax(t *testing.T) {
+	if n := argMax(); n < defaultArgMax {
+		t.Errorf("argMax() == %d, less than %d", n, defaultArgMax)
+	}
+}
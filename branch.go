@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/google/zoekt/query"
+)
+
+func hasBranchQuery(q query.Q) bool {
+	hasBranch := false
+	query.VisitAtoms(q, func(q query.Q) {
+		if _, ok := q.(*query.Branch); ok {
+			hasBranch = true
+		}
+	})
+	return hasBranch
+}
+
+// splitBranchQuery returns the revisions named by the branch: atoms in q,
+// and q without them. The branch: atoms must apply to the whole query, eg
+// "foo branch:a" or "foo (branch:a or branch:b)".
+func splitBranchQuery(q query.Q) ([]string, query.Q, error) {
+	children := []query.Q{q}
+	if and, ok := q.(*query.And); ok {
+		children = and.Children
+	}
+
+	var (
+		revs []string
+		rest []query.Q
+	)
+	for _, ch := range children {
+		if r := branchRevs(ch); r != nil && revs == nil {
+			revs = r
+			continue
+		}
+		rest = append(rest, ch)
+	}
+
+	restQ := query.Simplify(&query.And{Children: rest})
+	if hasBranchQuery(restQ) {
+		return nil, nil, fmt.Errorf("branch: must apply to the whole query")
+	}
+	return revs, restQ, nil
+}
+
+// branchRevs returns the revisions if q is a branch: atom or an or of
+// branch: atoms.
+func branchRevs(q query.Q) []string {
+	switch s := q.(type) {
+	case *query.Branch:
+		return []string{s.Pattern}
+	case *query.Or:
+		var revs []string
+		for _, ch := range s.Children {
+			b, ok := ch.(*query.Branch)
+			if !ok {
+				return nil
+			}
+			revs = append(revs, b.Pattern)
+		}
+		return revs
+	}
+	return nil
+}
+
+// searchBranches searches the revisions revs of repos with git grep, writing
+// the results to w in the --format selected. Human lines are prefixed with
+// repo@rev.
+func searchBranches(w io.Writer, q query.Q, revs []string, opts searchOptions, repos []repoPath) int {
+	var runs []*rgRun
+	if _, ok := q.(*query.Const); ok {
+		// Only branch atoms, so list the files.
+		runs = []*rgRun{{Args: []string{"--files"}}}
+	} else {
+		var err error
+		runs, err = ripgrepRuns(q, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cwd := len(repos) == 0
+	if cwd {
+		dir, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		repos = []repoPath{{Repo: filepath.Base(dir), Path: "."}}
+	}
+
+	var f formatter
+	if outputFormat != "human" {
+		f = newFormatter()
+	}
+
+	code := 1
+	for _, rp := range repos {
+		for _, rev := range revs {
+			if !gitHasRev(rp.Path, rev) {
+				fmt.Fprintf(os.Stderr, "rgp: %s: unknown revision %s, skipping\n", rp.Repo, rev)
+				continue
+			}
+			b := &gitBackend{dir: rp.Path, rev: rev}
+			prefix := rp.Repo + "@" + rev + ":"
+			seen := map[string]bool{}
+			for _, run := range runs {
+				lines, c := run.output(b, nil, opts)
+				code = combineExitStatus(code, c)
+				for _, l := range lines {
+					s := prefix + l.String()
+					if seen[s] {
+						continue
+					}
+					seen[s] = true
+					if f == nil {
+						fmt.Fprintln(w, s)
+						continue
+					}
+					r, ok := l.result("")
+					if !ok {
+						continue
+					}
+					if !cwd {
+						r.Repo = rp.Path
+					}
+					r.Rev = rev
+					if err := f.format(w, r); err != nil {
+						log.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+	return code
+}
+
+func gitHasRev(dir, rev string) bool {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// gitGrepPCRE is false once git grep -P has failed because git was built
+// without PCRE. Patterns are then translated to POSIX extended regexps.
+var gitGrepPCRE = true
+
+// gitBackend searches a git revision with git grep.
+type gitBackend struct {
+	dir string
+	rev string
+}
+
+func (b *gitBackend) lines(args, paths []string) ([]rgLine, int) {
+	a, err := parseRgArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if a.Mode != modeLines {
+		files, code := b.grep(a, paths)
+		lines := make([]rgLine, len(files))
+		for i, path := range files {
+			lines[i] = rgLine{Path: path}
+		}
+		return lines, code
+	}
+
+	out, code := b.grep(a, paths)
+	var lines []rgLine
+	for _, s := range out {
+		// -z output looks like "rev:path\0line\0text"
+		parts := strings.SplitN(s, "\x00", 3)
+		if len(parts) != 3 {
+			lines = append(lines, rgLine{Text: s})
+			continue
+		}
+		lines = append(lines, rgLine{
+			Path:    parts[0],
+			Sep:     ':',
+			LineNum: parts[1],
+			Text:    parts[2],
+		})
+	}
+	return lines, code
+}
+
+func (b *gitBackend) files(args, paths []string) ([]string, int) {
+	a, err := parseRgArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b.grep(a, paths)
+}
+
+// grep runs git grep and returns its output lines, with the revision
+// prefix removed. In a file listing mode each line is a path.
+func (b *gitBackend) grep(a *rgArgs, paths []string) ([]string, int) {
+	out, code, noPCRE := b.run(a, paths)
+	if noPCRE {
+		gitGrepPCRE = false
+		out, code, _ = b.run(a, paths)
+	}
+	return out, code
+}
+
+// run runs git grep, with -P if gitGrepPCRE. noPCRE is true if it failed
+// since git does not support -P.
+func (b *gitBackend) run(a *rgArgs, paths []string) (out []string, code int, noPCRE bool) {
+	args := []string{"grep", "-I", "--no-color", "-z"}
+	patterns := a.Patterns
+	if gitGrepPCRE {
+		args = append(args, "-P")
+	} else {
+		args = append(args, "-E")
+		patterns = make([]string, len(a.Patterns))
+		for i, p := range a.Patterns {
+			ere, err := posixRegexp(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rgp: git grep does not support -P: %v\n", err)
+				return nil, 2, false
+			}
+			patterns[i] = ere
+		}
+	}
+	switch a.Mode {
+	case modeLines:
+		args = append(args, "-n")
+	case modeFiles:
+		args = append(args, "-l", "-e", "^")
+	case modeFilesWithMatches:
+		args = append(args, "-l")
+	case modeFilesWithoutMatch:
+		args = append(args, "-L")
+	}
+	if a.IgnoreCase {
+		args = append(args, "-i")
+	}
+	if a.Invert {
+		args = append(args, "-v")
+	}
+	for _, p := range patterns {
+		args = append(args, "-e", p)
+	}
+	args = append(args, b.rev, "--")
+	if len(paths) > 0 {
+		// paths were already filtered by the globs.
+		for _, p := range paths {
+			if p != explainFiles {
+				p = ":(literal)" + p
+			}
+			args = append(args, p)
+		}
+	} else {
+		args = append(args, gitPathspecs(a)...)
+	}
+
+	if debug {
+		log.Println(append([]string{"git"}, args...))
+	}
+	if explain {
+		explainCommand("git", append([]string{"-C", b.dir}, args...))
+		if a.Mode == modeLines {
+			return nil, 0, false
+		}
+		return []string{explainFiles}, 0, false
+	}
+	var buf, errBuf bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = b.dir
+	cmd.Stdout = &buf
+	cmd.Stderr = &errBuf
+	code = exitStatus(cmd.Run())
+	if code > 1 {
+		code = 2
+		// git says "cannot use Perl-compatible regexes when not
+		// compiled with USE_LIBPCRE".
+		if gitGrepPCRE && strings.Contains(errBuf.String(), "USE_LIBPCRE") {
+			return nil, code, true
+		}
+	}
+	os.Stderr.Write(errBuf.Bytes())
+
+	if a.Mode == modeLines {
+		out = splitLines(buf.Bytes())
+	} else {
+		out = splitNull(buf.Bytes())
+	}
+	prefix := b.rev + ":"
+	for i := range out {
+		out[i] = strings.TrimPrefix(out[i], prefix)
+	}
+	return out, code, false
+}
+
+// gitPathspecs converts the globs and file types in a into git pathspecs.
+// Unlike ripgrep, git combines positive globs and types with or.
+func gitPathspecs(a *rgArgs) []string {
+	var specs []string
+	for _, g := range a.Globs {
+		specs = append(specs, gitPathspec(g.Pattern, g.CaseSensitive, g.Negated))
+	}
+	for _, t := range a.Types {
+		for _, g := range t.Globs {
+			specs = append(specs, gitPathspec(g, true, t.Negated))
+		}
+	}
+	return specs
+}
+
+func gitPathspec(glob string, caseSensitive, negated bool) string {
+	magic := []string{"glob"}
+	if !caseSensitive {
+		magic = append(magic, "icase")
+	}
+	if negated {
+		magic = append(magic, "exclude")
+	}
+	// ripgrep globs without a slash match the base name, while a leading
+	// slash anchors the glob to the root.
+	if strings.HasPrefix(glob, "/") {
+		glob = glob[1:]
+	} else if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	return ":(" + strings.Join(magic, ",") + ")" + glob
+}
+
+// posixRegexp translates the ripgrep regexp p into a POSIX extended regexp
+// which matches the same lines. Word boundaries have no POSIX equivalent,
+// so are an error.
+func posixRegexp(p string) (string, error) {
+	re, err := syntax.Parse(p, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := writePosixRegexp(&buf, re); err != nil {
+		return "", fmt.Errorf("%s: %v", p, err)
+	}
+	return buf.String(), nil
+}
+
+func writePosixRegexp(buf *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		buf.WriteString("()")
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.SimpleFold(r) != r {
+				writePosixClass(buf, foldRanges(r))
+			} else if strings.ContainsRune(`\.[]()*+?{}|^$`, r) {
+				buf.WriteString(`\` + string(r))
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	case syntax.OpCharClass:
+		writePosixClass(buf, re.Rune)
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		// git grep matches lines, so there are no newlines to match.
+		buf.WriteByte('.')
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		buf.WriteByte('^')
+	case syntax.OpEndLine, syntax.OpEndText:
+		buf.WriteByte('$')
+	case syntax.OpCapture:
+		buf.WriteByte('(')
+		if err := writePosixRegexp(buf, re.Sub[0]); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		// Greediness does not change which lines match.
+		sub := re.Sub[0]
+		group := !(sub.Op == syntax.OpLiteral && len(sub.Rune) == 1 && sub.Flags&syntax.FoldCase == 0) &&
+			sub.Op != syntax.OpCharClass && sub.Op != syntax.OpAnyChar && sub.Op != syntax.OpAnyCharNotNL
+		if group {
+			buf.WriteByte('(')
+		}
+		if err := writePosixRegexp(buf, sub); err != nil {
+			return err
+		}
+		if group {
+			buf.WriteByte(')')
+		}
+		switch {
+		case re.Op == syntax.OpStar:
+			buf.WriteByte('*')
+		case re.Op == syntax.OpPlus:
+			buf.WriteByte('+')
+		case re.Op == syntax.OpQuest:
+			buf.WriteByte('?')
+		case re.Max < 0:
+			fmt.Fprintf(buf, "{%d,}", re.Min)
+		default:
+			fmt.Fprintf(buf, "{%d,%d}", re.Min, re.Max)
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			group := sub.Op == syntax.OpAlternate
+			if group {
+				buf.WriteByte('(')
+			}
+			if err := writePosixRegexp(buf, sub); err != nil {
+				return err
+			}
+			if group {
+				buf.WriteByte(')')
+			}
+		}
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			if i > 0 {
+				buf.WriteByte('|')
+			}
+			if err := writePosixRegexp(buf, sub); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s has no POSIX equivalent", re)
+	}
+	return nil
+}
+
+// foldRanges returns the character class of the runes r case folds to.
+func foldRanges(r rune) []rune {
+	var ranges []rune
+	for f := r; ; {
+		ranges = append(ranges, f, f)
+		if f = unicode.SimpleFold(f); f == r {
+			return ranges
+		}
+	}
+}
+
+// writePosixClass writes the character class ranges, pairs of runes, as a
+// POSIX bracket expression. Backslashes are not special in brackets, while
+// ], [, ^ and - are only literal in certain places, so those are written
+// separately.
+func writePosixClass(buf *strings.Builder, ranges []rune) {
+	negate := len(ranges) > 0 && ranges[0] == 0 && ranges[len(ranges)-1] == unicode.MaxRune
+	if negate {
+		// The class was written negated, and NUL can not be passed to
+		// git, so negate it back.
+		var inv []rune
+		next := rune(0)
+		for i := 0; i < len(ranges); i += 2 {
+			if ranges[i] > next {
+				inv = append(inv, next, ranges[i]-1)
+			}
+			next = ranges[i+1] + 1
+		}
+		ranges = inv
+	}
+	const specials = "][^-"
+	var (
+		special [len(specials)]bool
+		body    strings.Builder
+	)
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		for changed := true; changed && lo <= hi; {
+			changed = false
+			for j, c := range specials {
+				if lo > hi {
+					break
+				}
+				if lo == c {
+					special[j], lo, changed = true, lo+1, true
+				} else if hi == c {
+					special[j], hi, changed = true, hi-1, true
+				}
+			}
+		}
+		switch {
+		case lo > hi:
+		case lo == hi:
+			body.WriteRune(lo)
+		default:
+			body.WriteRune(lo)
+			body.WriteByte('-')
+			body.WriteRune(hi)
+		}
+	}
+	if !negate && body.Len() == 0 && special == [len(specials)]bool{2: true} {
+		// [^] would be a negation.
+		buf.WriteString(`\^`)
+		return
+	}
+	buf.WriteByte('[')
+	if negate {
+		buf.WriteByte('^')
+	}
+	// ] is literal first, and - last. [ must not be followed by ., : or
+	// =, and ^ must not be first.
+	if special[0] {
+		buf.WriteByte(']')
+	}
+	buf.WriteString(body.String())
+	if special[1] {
+		buf.WriteByte('[')
+	}
+	if special[2] && (negate || special[0] || body.Len() > 0 || special[1]) {
+		buf.WriteByte('^')
+		special[2] = false
+	}
+	if special[3] {
+		buf.WriteByte('-')
+	}
+	if special[2] {
+		// Only ^ and -, so - went first.
+		buf.WriteByte('^')
+	}
+	buf.WriteByte(']')
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitBranchQuery(t *testing.T) {
+	cases := []struct {
+		Query string
+		Revs  []string
+		Rest  string
+	}{
+		{"foo branch:release-1.2", []string{"release-1.2"}, `substr:"foo"`},
+		{"foo rev:v1.0.0", []string{"v1.0.0"}, `substr:"foo"`},
+		{"foo (b:a or b:b) f:*.go", []string{"a", "b"}, `(and substr:"foo" glob:"*.go")`},
+		{"branch:main", []string{"main"}, "TRUE"},
+		{"(foo branch:a) or bar", nil, ""},
+		{"branch:a branch:b", nil, ""},
+	}
+	for _, tt := range cases {
+		q, _, err := parseQuery(tt.Query)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		revs, rest, err := splitBranchQuery(q)
+		if err != nil {
+			if tt.Revs != nil {
+				t.Errorf("%s got error %v", tt.Query, err)
+			}
+			continue
+		}
+		if tt.Revs == nil {
+			t.Errorf("%s expected error", tt.Query)
+			continue
+		}
+		if !reflect.DeepEqual(revs, tt.Revs) || rest.String() != tt.Rest {
+			t.Errorf("%s == %v %s != %v %s", tt.Query, revs, rest, tt.Revs, tt.Rest)
+		}
+	}
+}
+
+func TestGitBackend(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "rgp-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=rgp", "-c", "user.email=rgp@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	write("main.go", "// TODO fix\n// TODO FIXME later\n")
+	write("docs/README.md", "TODO write docs\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+	git("tag", "v1")
+	write("main.go", "// nothing to do\n")
+	git("commit", "-q", "-am", "done")
+
+	cases := []struct {
+		Query string
+		Want  []string
+	}{
+		{"TODO", []string{"docs/README.md:1:TODO write docs", "main.go:1:// TODO fix", "main.go:2:// TODO FIXME later"}},
+		{"TODO -FIXME f:*.go", []string{"main.go:1:// TODO fix"}},
+		{"todo later", []string{"main.go:2:// TODO FIXME later"}},
+		{"TODO -FIXME scope:file", []string{"docs/README.md:1:TODO write docs"}},
+		{"-f:*.md", []string{"main.go"}},
+	}
+	b := &gitBackend{dir: dir, rev: "v1"}
+	// Without PCRE patterns are translated for git grep -E.
+	defer func() { gitGrepPCRE = true }()
+	for _, pcre := range []bool{true, false} {
+		gitGrepPCRE = pcre
+		for _, tt := range cases {
+			q, opts, err := parseQuery(tt.Query)
+			if err != nil {
+				t.Fatal(tt.Query, err)
+			}
+			runs, err := ripgrepRuns(q, opts)
+			if err != nil {
+				t.Fatal(tt.Query, err)
+			}
+			var got []string
+			for _, run := range runs {
+				lines, _ := run.output(b, nil, opts)
+				for _, l := range lines {
+					got = append(got, l.String())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.Want) {
+				t.Errorf("%s == %q != %q (pcre=%v)", tt.Query, got, tt.Want, pcre)
+			}
+		}
+	}
+}
+
+func TestPosixRegexp(t *testing.T) {
+	cases := []struct {
+		Pattern string
+		Want    string
+	}{
+		{"foo", "foo"},
+		{"a.b*", "a.b*"},
+		{`\d+\.go$`, `[0-9]+\.go$`},
+		{"(?i)todo", "[Tt][Oo][Dd][Oo]"},
+		{"(foo|bar)+baz", "((foo|bar))+baz"},
+		{"ab{2,}c{1,3}", "ab{2,}c{1,3}"},
+		{"x.*?y", "x.*y"},
+		{`[^\]a-]`, "[^]a-]"},
+		{`[\^\-]`, "[-^]"},
+		{`[\[.]`, "[.[]"},
+		{`a\[b\]\^`, `a\[b\]\^`},
+	}
+	for _, tt := range cases {
+		got, err := posixRegexp(tt.Pattern)
+		if err != nil {
+			t.Errorf("posixRegexp(%q) failed: %v", tt.Pattern, err)
+		} else if got != tt.Want {
+			t.Errorf("posixRegexp(%q) == %q != %q", tt.Pattern, got, tt.Want)
+		}
+	}
+	if _, err := posixRegexp(`\bfoo\b`); err == nil {
+		t.Error("expected word boundaries to have no POSIX equivalent")
+	}
+}
+
+func TestSearchBranchesFormat(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "rgp-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=rgp", "-c", "user.email=rgp@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("// TODO fix\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+	git("tag", "v1")
+
+	cases := []struct {
+		Format string
+		Want   string
+	}{
+		{"human", "app@v1:main.go:1:// TODO fix\n"},
+		{"vimgrep", filepath.Join(dir, "main.go") + ":1:1:// TODO fix\n"},
+		{"json", `{"repo":"` + dir + `","rev":"v1","path":"main.go","line":1,"text":"// TODO fix"}` + "\n"},
+	}
+	defer func(format string) { outputFormat = format }(outputFormat)
+	q, opts, err := parseQuery("TODO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := []repoPath{{Repo: "app", Path: dir}}
+	for _, tt := range cases {
+		outputFormat = tt.Format
+		var buf bytes.Buffer
+		code := searchBranches(&buf, q, []string{"v1"}, opts, repos)
+		if code != 0 || buf.String() != tt.Want {
+			t.Errorf("%s: got %d %q, want 0 %q", tt.Format, code, buf.String(), tt.Want)
+		}
+	}
+}
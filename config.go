@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// config is the rgp configuration file. For example
+//
+//	{
+//	  "repogroups": {
+//	    "backend": {
+//	      "repos": ["github.com/acme/api", "auth"],
+//	      "patterns": ["acme/*-service"],
+//	      "contains": ["go.mod"]
+//	    }
+//	  },
+//	  "walk": {"workers": 8, "maxdepth": 3},
+//	  "search": {"workers": 4}
+//	}
+type config struct {
+	RepoGroups map[string]*repoGroup `json:"repogroups"`
+
+	// Walk configures how SRCPATH is walked to find repos.
+	Walk struct {
+		// Workers is the number of directories read at once.
+		Workers int `json:"workers,omitempty"`
+
+		// MaxDepth is how many directories below a SRCPATH root
+		// repos can be, eg 3 for github.com/owner/name.
+		MaxDepth int `json:"maxdepth,omitempty"`
+	} `json:"walk"`
+
+	// Search configures how repos are searched.
+	Search struct {
+		// Workers is the number of repos searched at once.
+		Workers int `json:"workers,omitempty"`
+	} `json:"search"`
+}
+
+// repoGroup is a named set of repos, used by the repogroup: atom. A repo is
+// in the group if it matches any of the fields.
+type repoGroup struct {
+	// Repos are repo names, either the path name or the canonical name.
+	Repos []string `json:"repos,omitempty"`
+
+	// Patterns are repo: patterns.
+	Patterns []string `json:"patterns,omitempty"`
+
+	// Contains are paths, relative to the root of the repo, which the repo
+	// must contain. They can be globs, eg "*.proto".
+	Contains []string `json:"contains,omitempty"`
+}
+
+// configPath returns the path of the config file. It is RGP_CONFIG if set,
+// otherwise rgp/config.json in the user config dir.
+func configPath() (string, error) {
+	if path := os.Getenv("RGP_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rgp", "config.json"), nil
+}
+
+// readConfig reads the config file at path. A missing file is an empty
+// config.
+func readConfig(path string) (*config, error) {
+	c := &config{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, g := range c.RepoGroups {
+		for _, p := range g.Patterns {
+			if _, err := compileRepoPattern(p); err != nil {
+				return nil, fmt.Errorf("%s: repo group %s: %v", path, name, err)
+			}
+		}
+		for _, p := range g.Contains {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("%s: repo group %s: invalid contains glob %q", path, name, p)
+			}
+		}
+	}
+	return c, nil
+}
+
+var (
+	configOnce sync.Once
+	rgpConfig  *config
+	configErr  error
+)
+
+// loadConfig returns the config file, reading it on first use. It is a
+// variable so tests do not depend on the user's config.
+var loadConfig = func() (*config, error) {
+	configOnce.Do(func() {
+		path, err := configPath()
+		if err != nil {
+			configErr = err
+			return
+		}
+		rgpConfig, configErr = readConfig(path)
+	})
+	return rgpConfig, configErr
+}
+
+// repoGroupNames returns the names of the configured repo groups, sorted.
+func repoGroupNames() []string {
+	c, err := loadConfig()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for name := range c.RepoGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Match reports whether rp is in the group.
+func (g *repoGroup) Match(rp repoPath) bool {
+	for _, name := range g.Repos {
+		if rp.Repo == name || (rp.Name != "" && rp.Name == name) {
+			return true
+		}
+	}
+	for _, p := range g.Patterns {
+		if cachedRepoMatcher(p).MatchRepo(rp) {
+			return true
+		}
+	}
+	for _, p := range g.Contains {
+		if matches, _ := filepath.Glob(filepath.Join(rp.Path, p)); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repoGroupQuery is the repogroup: atom. It matches the repos in a group
+// from the config file.
+type repoGroupQuery struct {
+	Name  string
+	Group *repoGroup
+}
+
+func (q *repoGroupQuery) String() string {
+	return "repogroup:" + q.Name
+}
+
+// parseRepoGroup returns the repogroup: atom for the group name.
+func parseRepoGroup(name string) (*repoGroupQuery, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	g, ok := c.RepoGroups[name]
+	if !ok {
+		names := repoGroupNames()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown repo group %q, no groups are configured", name)
+		}
+		return nil, fmt.Errorf("unknown repo group %q, want one of %v", name, names)
+	}
+	return &repoGroupQuery{Name: name, Group: g}, nil
+}
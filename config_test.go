@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	c, err := readConfig(path)
+	if err != nil || len(c.RepoGroups) != 0 {
+		t.Fatalf("missing config should be empty, got %v %v", c, err)
+	}
+
+	bad := map[string]string{
+		"syntax":   `{"repogroups": {`,
+		"pattern":  `{"repogroups": {"a": {"patterns": ["(foo"]}}}`,
+		"contains": `{"repogroups": {"a": {"contains": ["[x"]}}}`,
+	}
+	for name, content := range bad {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("expected error for invalid %s", name)
+		}
+	}
+}
+
+func TestRepoGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-repogroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "api.proto"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &repoGroup{
+		Repos:    []string{"github.com/acme/auth"},
+		Patterns: []string{"acme/*-service"},
+		Contains: []string{"*.proto"},
+	}
+	cases := []struct {
+		Repo repoPath
+		Want bool
+	}{
+		{repoPath{Repo: "auth", Name: "github.com/acme/auth", Path: "/nonexistent"}, true},
+		{repoPath{Repo: "github.com/acme/billing-service", Path: "/nonexistent"}, true},
+		{repoPath{Repo: "protos", Path: dir}, true},
+		{repoPath{Repo: "github.com/acme/web", Path: "/nonexistent"}, false},
+	}
+	for _, tt := range cases {
+		if got := g.Match(tt.Repo); got != tt.Want {
+			t.Errorf("Match(%+v) == %v != %v", tt.Repo, got, tt.Want)
+		}
+	}
+
+	defer func(f func() (*config, error)) { loadConfig = f }(loadConfig)
+	loadConfig = func() (*config, error) {
+		return &config{RepoGroups: map[string]*repoGroup{"backend": g}}, nil
+	}
+	q, _, err := parseQuery("foo repogroup:backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasRepoQuery(q) {
+		t.Errorf("%s should be evaluated per repo", q)
+	}
+	if got := simplifyRepoQuery(q, cases[0].Repo).String(); got != `substr:"foo"` {
+		t.Errorf("unexpected simplified query %s", got)
+	}
+	if _, _, err := parseQuery("repogroup:frontend"); err == nil {
+		t.Error("expected error for unknown repo group")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// explain is set by --explain. Instead of searching, rgp prints the query
+// plan and the commands it would run.
+var explain bool
+
+// explainFiles stands in for the files found by an earlier command when
+// explaining, since we do not run it.
+const explainFiles = "$FILES"
+
+// explainf prints a line of the explanation.
+func explainf(format string, args ...interface{}) {
+	fmt.Printf("# "+format+"\n", args...)
+}
+
+// explainCommand prints the command line name args.
+func explainCommand(name string, args []string) {
+	fmt.Println("$ " + shellQuote(append([]string{name}, args...)))
+}
+
+// shellQuote joins args into a command line suitable for a POSIX shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuoteArg(arg string) string {
+	if arg == explainFiles {
+		return arg
+	}
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range arg {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("_@%+=:,./-", c):
+		default:
+			safe = false
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		Args []string
+		Want string
+	}{
+		{[]string{"rg", "-i", "-e", "foo"}, "rg -i -e foo"},
+		{[]string{"rg", "--iglob", "*.go", "-e", "foo.*?bar"}, "rg --iglob '*.go' -e 'foo.*?bar'"},
+		{[]string{"rg", "-e", "it's", "-e", ""}, `rg -e 'it'\''s' -e ''`},
+		{[]string{"rg", "-e", "foo", explainFiles}, "rg -e foo $FILES"},
+	}
+	for _, tt := range cases {
+		if got := shellQuote(tt.Args); got != tt.Want {
+			t.Errorf("shellQuote(%q) == %s != %s", tt.Args, got, tt.Want)
+		}
+	}
+}
+
+func TestParseQueryTree(t *testing.T) {
+	parsed, _, err := parseQueryTree("foo order:yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _, err := parseQuery("foo order:yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed.String(), `(and substr:"foo" TRUE)`; got != want {
+		t.Errorf("parsed query %s != %s", got, want)
+	}
+	if got, want := q.String(), `substr:"foo"`; got != want {
+		t.Errorf("simplified query %s != %s", got, want)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package main
+
+import "os"
+
+// fileID identifies a file independently of the path used to reach it.
+type fileID struct{}
+
+// getFileID is not supported on this platform, so symlinks are not
+// followed.
+func getFileID(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
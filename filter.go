@@ -0,0 +1,449 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filterArgs are the ripgrep flags used when rgp needs to inspect the
+// output of ripgrep. They ensure each line can be parsed by parseLine.
+var filterArgs = []string{"--no-heading", "--with-filename", "--null", "--line-number", "--no-column", "--color", "never"}
+
+// rgLine is a line of ripgrep output produced with filterArgs.
+type rgLine struct {
+	Path string
+	// Sep is ':' for matching lines and '-' for context lines. It is 0
+	// for lines which only list a file, or lines not associated with a
+	// file such as the "--" context separator.
+	Sep     byte
+	LineNum string
+	Text    string
+}
+
+func parseLine(line string) rgLine {
+	i := strings.IndexByte(line, 0)
+	if i < 0 {
+		return rgLine{Text: line}
+	}
+	l := rgLine{Path: line[:i]}
+	rest := line[i+1:]
+	j := 0
+	for j < len(rest) && '0' <= rest[j] && rest[j] <= '9' {
+		j++
+	}
+	if j < len(rest) && (rest[j] == ':' || rest[j] == '-') {
+		l.LineNum = rest[:j]
+		l.Sep = rest[j]
+		rest = rest[j+1:]
+	}
+	l.Text = rest
+	return l
+}
+
+// String formats l like ripgrep does when not writing to a terminal.
+func (l rgLine) String() string {
+	if l.Sep == 0 {
+		if l.Path != "" && l.Text != "" {
+			return l.Path + ":" + l.Text
+		}
+		return l.Path + l.Text
+	}
+	sep := string(l.Sep)
+	return l.Path + sep + l.LineNum + sep + l.Text
+}
+
+// backend runs searches described by the ripgrep flags ripgrep() generates.
+type backend interface {
+	// lines returns the output of searching paths with args.
+	lines(args, paths []string) ([]rgLine, int)
+	// files returns the files under paths listed by args. args will
+	// contain a flag like --files-with-matches.
+	files(args, paths []string) ([]string, int)
+}
+
+// rgBackend runs ripgrep.
+type rgBackend struct {
+	// passthrough are flags the user specified for ripgrep.
+	passthrough []string
+
+	// excludes are globs which exclude nested repos. They come after the
+	// generated args so they take precedence over the query's globs.
+	excludes []string
+
+	// stderr is where ripgrep writes errors, os.Stderr if nil.
+	stderr io.Writer
+}
+
+func (b *rgBackend) errw() io.Writer {
+	if b.stderr == nil {
+		return os.Stderr
+	}
+	return b.stderr
+}
+
+func (b *rgBackend) lines(args, paths []string) ([]rgLine, int) {
+	if explain {
+		explainCommand("rg", concat(b.passthrough, args, b.excludes, filterArgs, paths))
+		return nil, 0
+	}
+	if listsFiles(args) {
+		files, code := b.files(args, paths)
+		lines := make([]rgLine, len(files))
+		for i, path := range files {
+			lines[i] = rgLine{Path: path}
+		}
+		return lines, code
+	}
+	out, code := rgOutput(concat(b.passthrough, args, b.excludes, filterArgs), paths, b.errw())
+	var lines []rgLine
+	for _, s := range splitLines(out) {
+		lines = append(lines, parseLine(s))
+	}
+	return lines, code
+}
+
+func (b *rgBackend) files(args, paths []string) ([]string, int) {
+	if explain {
+		explainCommand("rg", concat(b.passthrough, args, b.excludes, []string{"--null"}, paths))
+		return []string{explainFiles}, 0
+	}
+	out, code := rgOutput(concat(b.passthrough, args, b.excludes, []string{"--null"}), paths, b.errw())
+	return splitNull(out), code
+}
+
+// context returns the lines of context ripgrep prints around matches.
+func (b *rgBackend) context() (before, after int) {
+	return contextSizes(b.passthrough)
+}
+
+// contextBackend is a backend which can print lines of context around
+// matches, like ripgrep's -A, -B and -C.
+type contextBackend interface {
+	context() (before, after int)
+}
+
+// contextSizes returns the lines of context ripgrep prints before and after
+// each match with args. Like ripgrep, -A and -B take precedence over -C.
+func contextSizes(args []string) (before, after int) {
+	names := map[string]string{
+		"-A": "after", "--after-context": "after",
+		"-B": "before", "--before-context": "before",
+		"-C": "context", "--context": "context",
+	}
+	sizes := map[string]int{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		var name, value string
+		if _, ok := names[arg]; ok && i+1 < len(args) {
+			name, value = arg, args[i+1]
+			i++
+		} else if j := strings.IndexByte(arg, '='); j > 0 && strings.HasPrefix(arg, "--") {
+			name, value = arg[:j], arg[j+1:]
+		} else if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			name, value = arg[:2], arg[2:]
+		}
+		n, err := strconv.Atoi(value)
+		if kind, ok := names[name]; ok && err == nil {
+			sizes[kind] = n
+		}
+	}
+	before, after = sizes["context"], sizes["context"]
+	if n, ok := sizes["before"]; ok {
+		before = n
+	}
+	if n, ok := sizes["after"]; ok {
+		after = n
+	}
+	return before, after
+}
+
+// outputFlags are ripgrep flags which change the format of its output, so
+// can not be used when rgp reads the lines ripgrep prints.
+var outputFlags = map[string]bool{
+	"-o": true, "--only-matching": true,
+	"-c": true, "--count": true, "--count-matches": true,
+	"-l": true, "--files-with-matches": true, "--files-without-match": true,
+	"-q": true, "--quiet": true,
+	"--json": true, "--vimgrep": true,
+}
+
+// withoutOutputFlags returns passthrough without outputFlags, logging the
+// flags which are ignored.
+func withoutOutputFlags(passthrough []string) []string {
+	var kept []string
+	for i, arg := range passthrough {
+		if arg == "--" {
+			return append(kept, passthrough[i:]...)
+		}
+		if outputFlags[arg] {
+			log.Printf("ignoring %s since rgp filters ripgrep's output for this query", arg)
+			continue
+		}
+		kept = append(kept, arg)
+	}
+	return kept
+}
+
+// listsFiles returns true if args make ripgrep list files instead of
+// printing lines.
+func listsFiles(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--files", "--files-with-matches", "--files-without-match", "-l":
+			return true
+		}
+	}
+	return false
+}
+
+// filtered returns true if rgp needs to post-process r, rather than just
+// run ripgrep with r.Args.
+func (r *rgRun) filtered() bool {
+	return len(r.FileArgs) > 0 || len(r.Include) > 0 || len(r.Exclude) > 0
+}
+
+// output searches paths with b and returns the lines found with
+// r.FileArgs, r.Include and r.Exclude applied.
+func (r *rgRun) output(b backend, paths []string, opts searchOptions) ([]rgLine, int) {
+	if len(r.FileArgs) > 0 {
+		files, code := r.files(b, paths)
+		if len(files) == 0 {
+			return nil, code
+		}
+		paths = files
+		if explain {
+			explainf("%s are the files listed by every command above", explainFiles)
+		}
+	}
+
+	var (
+		excludeFiles map[string]bool
+		include      = compileAll(r.Include)
+		exclude      [][]*regexp.Regexp
+	)
+	if len(r.Exclude) == 0 {
+		// nothing to exclude
+	} else if opts.FileScope {
+		// First pass finds the files which contain a negated pattern.
+		// Patterns split into several regexes need a file to contain a
+		// match for each of them.
+		excludeArgs := []string{"--files-with-matches"}
+		var split []*rgRun
+		for _, res := range r.Exclude {
+			if len(res) == 1 {
+				excludeArgs = append(excludeArgs, "-e", res[0])
+				continue
+			}
+			run := &rgRun{}
+			for _, re := range res {
+				run.FileArgs = append(run.FileArgs, []string{"--files-with-matches", "-e", re})
+			}
+			split = append(split, run)
+		}
+		excludeFiles = map[string]bool{}
+		if len(excludeArgs) > 1 {
+			files, code := b.files(excludeArgs, paths)
+			if code == 2 {
+				return nil, code
+			}
+			for _, path := range files {
+				excludeFiles[path] = true
+			}
+		}
+		for _, run := range split {
+			files, code := run.files(b, paths)
+			if code == 2 {
+				return nil, code
+			}
+			for _, path := range files {
+				excludeFiles[path] = true
+			}
+		}
+	} else {
+		for _, res := range r.Exclude {
+			exclude = append(exclude, compileAll(res))
+		}
+	}
+
+	if excludeFiles != nil && explain {
+		explainf("exclude the files listed by the command above")
+	}
+
+	all, code := b.lines(r.Args, paths)
+	if explain {
+		for _, re := range include {
+			explainf("lines must match %s", re)
+		}
+		for _, res := range exclude {
+			var all []string
+			for _, re := range res {
+				all = append(all, re.String())
+			}
+			explainf("lines must not match %s", strings.Join(all, " and "))
+		}
+	}
+	if !r.filtered() {
+		return all, code
+	}
+	var lines []rgLine
+	// kept are the line numbers of the matches kept in each file.
+	kept := map[string][]int{}
+	// listed is true if a file listed by a run like --files is kept.
+	listed := false
+	for _, l := range all {
+		if excludeFiles[l.Path] {
+			continue
+		}
+		if l.Sep == ':' && (!matchesAll(include, l.Text) || excluded(exclude, l.Text)) {
+			continue
+		}
+		if l.Sep == ':' {
+			n, _ := strconv.Atoi(l.LineNum)
+			kept[l.Path] = append(kept[l.Path], n)
+		} else if l.Sep == 0 && l.Path != "" {
+			listed = true
+		}
+		lines = append(lines, l)
+	}
+	if c, ok := b.(contextBackend); ok && !listsFiles(r.Args) {
+		if before, after := c.context(); before > 0 || after > 0 {
+			lines = dropOrphanedContext(lines, kept, before, after)
+		}
+	}
+	if code == 0 && len(kept) == 0 && !listed && !explain {
+		code = 1
+	}
+	return lines, code
+}
+
+// dropOrphanedContext removes the context lines of matches which were
+// filtered out of lines. kept are the line numbers of the matches left in
+// each file. The "--" separators ripgrep prints between groups of lines are
+// redone, since groups can be removed or split.
+func dropOrphanedContext(lines []rgLine, kept map[string][]int, before, after int) []rgLine {
+	var (
+		out  []rgLine
+		last rgLine
+		prev int
+	)
+	for _, l := range lines {
+		if l.Sep == 0 && l.Path == "" && l.Text == "--" {
+			continue
+		}
+		n, _ := strconv.Atoi(l.LineNum)
+		if l.Sep == '-' && !nearMatch(kept[l.Path], n, before, after) {
+			continue
+		}
+		if len(out) > 0 && (l.Path != last.Path || n != prev+1) {
+			out = append(out, rgLine{Text: "--"})
+		}
+		out = append(out, l)
+		last, prev = l, n
+	}
+	return out
+}
+
+// nearMatch returns true if line n is within the context of one of the
+// matching lines.
+func nearMatch(matches []int, n, before, after int) bool {
+	for _, m := range matches {
+		if m-before <= n && n <= m+after {
+			return true
+		}
+	}
+	return false
+}
+
+// files returns the files under paths which are listed by every run in
+// r.FileArgs.
+func (r *rgRun) files(b backend, paths []string) ([]string, int) {
+	var files map[string]bool
+	for _, fileArgs := range r.FileArgs {
+		listed, code := b.files(fileArgs, paths)
+		if code != 0 {
+			return nil, code
+		}
+		found := map[string]bool{}
+		for _, path := range listed {
+			if files == nil || files[path] {
+				found[path] = true
+			}
+		}
+		if len(found) == 0 {
+			return nil, 1
+		}
+		files = found
+	}
+
+	sorted := make([]string, 0, len(files))
+	for path := range files {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted, 0
+}
+
+func compileAll(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+func matchesAll(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if !re.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// excluded returns true if s matches every regex of one of exclude.
+func excluded(exclude [][]*regexp.Regexp, s string) bool {
+	for _, res := range exclude {
+		if matchesAll(res, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// splitNull splits the output of a command run with a flag like --null
+// which separates file names with NUL.
+func splitNull(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\x00")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\x00")
+}
+
+func concat(parts ...[]string) []string {
+	var all []string
+	for _, p := range parts {
+		all = append(all, p...)
+	}
+	return all
+}
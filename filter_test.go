@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		Line string
+		Want rgLine
+		Out  string
+	}{
+		{"a.go\x0012:foo bar", rgLine{Path: "a.go", Sep: ':', LineNum: "12", Text: "foo bar"}, "a.go:12:foo bar"},
+		{"a.go\x003-10:00", rgLine{Path: "a.go", Sep: '-', LineNum: "3", Text: "10:00"}, "a.go-3-10:00"},
+		{"--", rgLine{Text: "--"}, "--"},
+	}
+	for _, tt := range cases {
+		got := parseLine(tt.Line)
+		if got != tt.Want {
+			t.Errorf("parseLine(%q) == %+v != %+v", tt.Line, got, tt.Want)
+		}
+		if got.String() != tt.Out {
+			t.Errorf("parseLine(%q).String() == %q != %q", tt.Line, got.String(), tt.Out)
+		}
+	}
+}
+
+func TestWithoutOutputFlags(t *testing.T) {
+	cases := []struct {
+		Passthrough []string
+		Want        []string
+	}{
+		{[]string{"-o"}, nil},
+		{[]string{"-c", "-i"}, []string{"-i"}},
+		{[]string{"-l", "--hidden"}, []string{"--hidden"}},
+		{[]string{"--json", "-A", "2"}, []string{"-A", "2"}},
+		{[]string{"-g", "*.go", "--", "-o"}, []string{"-g", "*.go", "--", "-o"}},
+	}
+	for _, tt := range cases {
+		if got := withoutOutputFlags(tt.Passthrough); !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("withoutOutputFlags(%q) == %q != %q", tt.Passthrough, got, tt.Want)
+		}
+	}
+}
+
+func TestContextSizes(t *testing.T) {
+	cases := []struct {
+		Args          []string
+		Before, After int
+	}{
+		{nil, 0, 0},
+		{[]string{"-C", "2"}, 2, 2},
+		{[]string{"-A3", "--context=1"}, 1, 3},
+		{[]string{"--before-context", "4", "-n"}, 4, 0},
+		{[]string{"--", "-C", "2"}, 0, 0},
+	}
+	for _, tt := range cases {
+		if before, after := contextSizes(tt.Args); before != tt.Before || after != tt.After {
+			t.Errorf("contextSizes(%q) == %d, %d != %d, %d", tt.Args, before, after, tt.Before, tt.After)
+		}
+	}
+}
+
+// contextLines is a backend which returns the lines of a search with one
+// line of context.
+type contextLines []string
+
+func (c contextLines) lines(args, paths []string) ([]rgLine, int) {
+	var lines []rgLine
+	for _, s := range c {
+		lines = append(lines, parseLine(s))
+	}
+	return lines, 0
+}
+
+func (c contextLines) files(args, paths []string) ([]string, int) {
+	return nil, 1
+}
+
+func (c contextLines) context() (before, after int) {
+	return 1, 1
+}
+
+func TestOrphanedContext(t *testing.T) {
+	b := contextLines{
+		"a.go\x001-before foo",
+		"a.go\x002:foo bar",
+		"a.go\x003-after foo",
+		"a.go\x004:foo",
+		"a.go\x005-after",
+		"--",
+		"a.go\x009-before",
+		"a.go\x0010:foo bar",
+		"a.go\x0011-after",
+		"--",
+		"b.go\x007-before",
+		"b.go\x008:foo",
+		"b.go\x009-after",
+	}
+	// Lines must also match bar, which drops a.go:4 and b.go:8.
+	r := &rgRun{Args: []string{"-e", "foo"}, Include: []string{"bar"}}
+	lines, code := r.output(b, nil, searchOptions{})
+	var got []string
+	for _, l := range lines {
+		got = append(got, l.String())
+	}
+	want := []string{
+		"a.go-1-before foo",
+		"a.go:2:foo bar",
+		"a.go-3-after foo",
+		"--",
+		"a.go-9-before",
+		"a.go:10:foo bar",
+		"a.go-11-after",
+	}
+	if !reflect.DeepEqual(got, want) || code != 0 {
+		t.Errorf("got %q %d want %q", got, code, want)
+	}
+}
+
+// listedFiles is a backend which lists the same files for every search.
+type listedFiles []string
+
+func (f listedFiles) lines(args, paths []string) ([]rgLine, int) {
+	var lines []rgLine
+	for _, path := range f {
+		lines = append(lines, rgLine{Path: path})
+	}
+	return lines, 0
+}
+
+func (f listedFiles) files(args, paths []string) ([]string, int) {
+	return nil, 1
+}
+
+func (f listedFiles) context() (before, after int) {
+	return 1, 1
+}
+
+func TestFilteredFilesExitStatus(t *testing.T) {
+	// Files are listed, and none contain the excluded terms.
+	r := &rgRun{Args: []string{"--files"}, Exclude: [][]string{{"foo", "bar"}}}
+	lines, code := r.output(listedFiles{"b.txt", "c.txt"}, nil, searchOptions{FileScope: true})
+	var got []string
+	for _, l := range lines {
+		got = append(got, l.String())
+	}
+	if want := []string{"b.txt", "c.txt"}; !reflect.DeepEqual(got, want) || code != 0 {
+		t.Errorf("got %q %d want %q 0", got, code, want)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// searchResult is a line found by a search.
+type searchResult struct {
+	// Repo is the path of the repo searched. It is empty when searching
+	// the working directory.
+	Repo string `json:"repo,omitempty"`
+	// Rev is the revision searched, for results from a branch: query. It
+	// is empty when searching the working tree.
+	Rev string `json:"rev,omitempty"`
+	// Path is the path of the file, relative to Repo.
+	Path string `json:"path"`
+	// Line is the line number, counting from 1. It is 0 when the result
+	// only lists Path.
+	Line int `json:"line,omitempty"`
+	// Column is the byte offset of the first submatch, counting from 1. It
+	// is 0 if unknown.
+	Column int `json:"column,omitempty"`
+	// Text is the line, without its newline.
+	Text string `json:"text,omitempty"`
+	// Context is true for lines around a match, rather than a match.
+	Context bool `json:"context,omitempty"`
+	// Submatches are the parts of Text which matched.
+	Submatches []submatch `json:"submatches,omitempty"`
+}
+
+// submatch is the part of searchResult.Text from byte offset Start to End.
+type submatch struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// displayPath returns the path of r as ripgrep would print it.
+func (r *searchResult) displayPath() string {
+	if r.Repo == "" {
+		return r.Path
+	}
+	return filepath.Join(r.Repo, r.Path)
+}
+
+// result converts l, found by searching repo, into a searchResult. Lines
+// from a backend do not say where they matched, so it has no submatches.
+// ok is false for lines not about a file, such as the "--" context
+// separator.
+func (l rgLine) result(repo string) (r *searchResult, ok bool) {
+	if l.Path == "" {
+		return nil, false
+	}
+	r = &searchResult{Repo: repo, Path: l.Path, Text: l.Text, Context: l.Sep == '-'}
+	if repo != "" {
+		if rel, err := filepath.Rel(repo, l.Path); err == nil {
+			r.Path = rel
+		}
+	}
+	if l.Sep != 0 {
+		r.Line, _ = strconv.Atoi(l.LineNum)
+	}
+	return r, true
+}
+
+// formatter writes search results. The results of a file are formatted one
+// after the other, in line order. A formatter is only used for the results
+// of one search, so can keep state between results.
+type formatter interface {
+	format(w io.Writer, r *searchResult) error
+}
+
+// formatters are the formatters --format can select. With the default
+// format, human, ripgrep prints the results itself.
+var formatters = map[string]func() formatter{
+	"json": func() formatter {
+		return jsonFormatter{}
+	},
+	"vimgrep": func() formatter {
+		return vimgrepFormatter{}
+	},
+}
+
+// outputFormat is the format selected with --format.
+var outputFormat = "human"
+
+// parseFormat sets the output format from the value of --format.
+func parseFormat(name string) error {
+	if _, ok := formatters[name]; !ok && name != "human" {
+		names := []string{"human"}
+		for name := range formatters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown format %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	outputFormat = name
+	return nil
+}
+
+// newFormatter returns the formatter selected with --format. It must not be
+// called with the human format.
+func newFormatter() formatter {
+	return formatters[outputFormat]()
+}
+
+// jsonFormatter writes each result as a line of JSON.
+type jsonFormatter struct{}
+
+func (jsonFormatter) format(w io.Writer, r *searchResult) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// vimgrepFormatter writes matches like rg --vimgrep, which editors can
+// parse. Context lines are skipped, and the column is 1 if unknown.
+type vimgrepFormatter struct{}
+
+func (vimgrepFormatter) format(w io.Writer, r *searchResult) error {
+	if r.Context {
+		return nil
+	}
+	if r.Line == 0 {
+		_, err := fmt.Fprintln(w, r.displayPath())
+		return err
+	}
+	column := r.Column
+	if column == 0 {
+		column = 1
+	}
+	_, err := fmt.Fprintf(w, "%s:%d:%d:%s\n", r.displayPath(), r.Line, column, r.Text)
+	return err
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// frecencyDB records how often and how recently repos are searched, so repo
+// completion can rank the repos you use first. Entries are keyed by repo
+// path.
+type frecencyDB struct {
+	Repos map[string]*frecencyEntry
+}
+
+type frecencyEntry struct {
+	Rank float64
+	Last time.Time
+}
+
+const (
+	// frecencyMaxRank bounds the total rank. Once exceeded every rank is
+	// aged, so repos you stop using fall out of the database.
+	frecencyMaxRank = 1000
+
+	// frecencyMinRank is the rank below which aged entries are dropped.
+	frecencyMinRank = 0.01
+)
+
+// score is the rank of e weighted by how recently it was used.
+func (e *frecencyEntry) score(now time.Time) float64 {
+	switch age := now.Sub(e.Last); {
+	case age < time.Hour:
+		return e.Rank * 4
+	case age < 24*time.Hour:
+		return e.Rank * 2
+	case age < 7*24*time.Hour:
+		return e.Rank / 2
+	default:
+		return e.Rank / 4
+	}
+}
+
+// add records a use of paths. A query over many repos says little about
+// each, so the weight of a use is shared between the paths.
+func (db *frecencyDB) add(paths []string, now time.Time) {
+	if len(paths) == 0 {
+		return
+	}
+	if db.Repos == nil {
+		db.Repos = map[string]*frecencyEntry{}
+	}
+	w := 1 / float64(len(paths))
+	for _, path := range paths {
+		e, ok := db.Repos[path]
+		if !ok {
+			e = &frecencyEntry{}
+			db.Repos[path] = e
+		}
+		e.Rank += w
+		e.Last = now
+	}
+
+	total := 0.0
+	for _, e := range db.Repos {
+		total += e.Rank
+	}
+	if total <= frecencyMaxRank {
+		return
+	}
+	for path, e := range db.Repos {
+		e.Rank *= 0.9
+		if e.Rank < frecencyMinRank {
+			delete(db.Repos, path)
+		}
+	}
+}
+
+// scores returns the frecency of each repo path in db.
+func (db *frecencyDB) scores(now time.Time) map[string]float64 {
+	scores := make(map[string]float64, len(db.Repos))
+	for path, e := range db.Repos {
+		scores[path] = e.score(now)
+	}
+	return scores
+}
+
+// dataDir returns the directory rgp keeps data in which is not a cache. It
+// respects XDG_DATA_HOME.
+func dataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "rgp"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "rgp"), nil
+}
+
+func frecencyPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "frecency.json"), nil
+}
+
+// loadFrecency reads the frecency database. A missing database is empty.
+func loadFrecency() (*frecencyDB, error) {
+	path, err := frecencyPath()
+	if err != nil {
+		return nil, err
+	}
+	db := &frecencyDB{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+func (db *frecencyDB) save() error {
+	path, err := frecencyPath()
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(path, db)
+}
+
+// frecencyLockTimeout is how long to wait for another rgp to update the
+// frecency database. A lock older than this was left behind by an rgp which
+// died, so is removed.
+const frecencyLockTimeout = 2 * time.Second
+
+// lockFrecency takes the lock guarding updates to the frecency database, so
+// concurrent searches do not lose each other's uses. The lock is a file
+// created with O_EXCL next to the database. It returns a function which
+// releases the lock.
+func lockFrecency() (func(), error) {
+	path, err := frecencyPath()
+	if err != nil {
+		return nil, err
+	}
+	lock := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lock), 0700); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(frecencyLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > frecencyLockTimeout {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s: timed out waiting for lock", lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordRepoUse adds a search of repos to the frecency database.
+func recordRepoUse(repos []repoPath) {
+	if explain || len(repos) == 0 {
+		return
+	}
+	var paths []string
+	for _, rp := range repos {
+		paths = append(paths, rp.Path)
+	}
+	if err := recordUse(paths); err != nil && debug {
+		log.Println("failed to record frecency:", err)
+	}
+}
+
+// recordUse adds a use of the repo paths to the frecency database.
+func recordUse(paths []string) error {
+	unlock, err := lockFrecency()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	db, err := loadFrecency()
+	if err != nil {
+		return err
+	}
+	db.add(paths, time.Now())
+	return db.save()
+}
+
+// frecencyScores returns the frecency of each repo path, for completion.
+func frecencyScores() map[string]float64 {
+	db, err := loadFrecency()
+	if err != nil {
+		return nil
+	}
+	return db.scores(time.Now())
+}
+
+// frecencyWeight is how much frecency counts when ranking completions, in
+// the units of fuzzyMatch scores.
+const frecencyWeight = 8
+
+// rankRepoMatch combines how well a repo matched with its frecency into a
+// single rank, higher is better. Frecency is dampened so it reorders
+// similar matches rather than promoting poor ones.
+func rankRepoMatch(score int, frecency float64) float64 {
+	return float64(score) + frecencyWeight*math.Log1p(frecency)
+}
+
+// frecencyCommand implements rgp frecency [--json] [--reset] [--open PATH...].
+func frecencyCommand(args []string) int {
+	fs := flag.NewFlagSet("frecency", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "print the stats as JSON")
+	reset := fs.Bool("reset", false, "forget all recorded repo use")
+	open := fs.Bool("open", false, "record opening the repos at the paths given as arguments")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "USAGE: %s frecency [--json] [--reset] [--open PATH...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Prints how often and how recently repos were searched or opened, which ranks repo: completion.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if *open {
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 2
+		}
+		var paths []string
+		for _, path := range fs.Args() {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			paths = append(paths, abs)
+		}
+		if err := recordUse(paths); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	if *reset {
+		unlock, err := lockFrecency()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer unlock()
+		path, err := frecencyPath()
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	db, err := loadFrecency()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	type stat struct {
+		Path  string    `json:"path"`
+		Rank  float64   `json:"rank"`
+		Last  time.Time `json:"last"`
+		Score float64   `json:"score"`
+	}
+	now := time.Now()
+	stats := []stat{}
+	for path, e := range db.Repos {
+		stats = append(stats, stat{Path: path, Rank: e.Rank, Last: e.Last, Score: e.score(now)})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Score != stats[j].Score {
+			return stats[i].Score > stats[j].Score
+		}
+		return stats[i].Path < stats[j].Path
+	})
+
+	if *jsonOut {
+		b, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		fmt.Printf("%s\n", b)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCORE\tRANK\tLAST\tPATH")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%.2f\t%.2f\t%s\t%s\n", s.Score, s.Rank, s.Last.Format("2006-01-02 15:04"), s.Path)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrecency(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := &frecencyDB{}
+	db.add([]string{"/src/api"}, now.Add(-30*24*time.Hour))
+	db.add([]string{"/src/api"}, now.Add(-30*24*time.Hour))
+	db.add([]string{"/src/web"}, now.Add(-time.Minute))
+	db.add([]string{"/src/a", "/src/b", "/src/c", "/src/d"}, now)
+
+	scores := db.scores(now)
+	if got, want := scores["/src/api"], 0.5; got != want {
+		t.Errorf("old repo score %v != %v", got, want)
+	}
+	if got, want := scores["/src/web"], 4.0; got != want {
+		t.Errorf("recent repo score %v != %v", got, want)
+	}
+	if got, want := scores["/src/a"], 1.0; got != want {
+		t.Errorf("shared use score %v != %v", got, want)
+	}
+
+	// Exceeding the max rank ages every entry, dropping unused ones.
+	db.Repos["/src/unused"] = &frecencyEntry{Rank: frecencyMinRank, Last: now}
+	db.Repos["/src/web"].Rank = frecencyMaxRank
+	db.add([]string{"/src/web"}, now)
+	if _, ok := db.Repos["/src/unused"]; ok {
+		t.Error("expected unused repo to be dropped")
+	}
+	if got := db.Repos["/src/web"].Rank; got >= frecencyMaxRank {
+		t.Errorf("expected rank to be aged, got %v", got)
+	}
+
+	// Frecency reorders similar matches, but not poor ones.
+	if rankRepoMatch(60, 10) <= rankRepoMatch(64, 0) {
+		t.Error("frecent repo should outrank a slightly better match")
+	}
+	if rankRepoMatch(30, 10) >= rankRepoMatch(64, 0) {
+		t.Error("frecent repo should not outrank a much better match")
+	}
+}
+
+func TestFrecencyDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_DATA_HOME", os.Getenv("XDG_DATA_HOME"))
+	os.Setenv("XDG_DATA_HOME", dir)
+
+	recordRepoUse([]repoPath{{Repo: "api", Path: "/src/api"}})
+	recordRepoUse([]repoPath{{Repo: "api", Path: "/src/api"}, {Repo: "web", Path: "/src/web"}})
+	db, err := loadFrecency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Repos["/src/api"].Rank; got != 1.5 {
+		t.Errorf("api rank %v != 1.5", got)
+	}
+	if got := db.Repos["/src/web"].Rank; got != 0.5 {
+		t.Errorf("web rank %v != 0.5", got)
+	}
+
+	if code := frecencyCommand([]string{"--open", "/src/web"}); code != 0 {
+		t.Fatalf("open exited %d", code)
+	}
+	if db, err := loadFrecency(); err != nil || db.Repos["/src/web"].Rank != 1.5 {
+		t.Errorf("expected open to be recorded, got %v %v", db, err)
+	}
+
+	// Concurrent searches do not lose each other's uses.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recordRepoUse([]repoPath{{Path: fmt.Sprintf("/src/repo%d", i)}})
+		}(i)
+	}
+	wg.Wait()
+	if db, err := loadFrecency(); err != nil || len(db.Repos) != 12 {
+		t.Errorf("expected every concurrent use to be recorded, got %v %v", db, err)
+	}
+
+	if code := frecencyCommand([]string{"--reset"}); code != 0 {
+		t.Fatalf("reset exited %d", code)
+	}
+	if db, err := loadFrecency(); err != nil || len(db.Repos) != 0 {
+		t.Errorf("expected empty db after reset, got %v %v", db, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"unicode"
+)
+
+// Scores for fuzzyMatch, modelled on fzf. A match earns fuzzyScoreMatch
+// per character, plus a bonus for characters at word boundaries. Gaps
+// between matched characters are penalised.
+const (
+	fuzzyScoreMatch        = 16
+	fuzzyGapStart          = -3
+	fuzzyGapExtension      = -1
+	fuzzyBonusBoundary     = 8
+	fuzzyBonusCamel        = 7
+	fuzzyBonusConsecutive  = 4
+	fuzzyBonusFirstCharMul = 2
+)
+
+// fuzzyMatch reports whether the characters of pattern appear in order in
+// s, and scores the best such match. Higher scores are better matches:
+// characters which are consecutive, start a path segment or word, or start
+// a camelCase hump score more. Matching is case insensitive unless pattern
+// contains upper case.
+func fuzzyMatch(pattern, s string) (int, bool) {
+	p, t := []rune(pattern), []rune(s)
+	if len(p) == 0 {
+		return 0, true
+	}
+	if len(p) > len(t) {
+		return 0, false
+	}
+	fold := true
+	for _, r := range p {
+		if unicode.IsUpper(r) {
+			fold = false
+			break
+		}
+	}
+	eq := func(a, b rune) bool {
+		if fold {
+			return unicode.ToLower(a) == unicode.ToLower(b)
+		}
+		return a == b
+	}
+
+	bonus := make([]int, len(t))
+	for j := range t {
+		bonus[j] = fuzzyBonus(t, j)
+	}
+
+	// prev[j] is the best score for p[:i] with p[i-1] matched at t[j], or
+	// noMatch.
+	const noMatch = -1 << 30
+	prev := make([]int, len(t))
+	cur := make([]int, len(t))
+	for j := range t {
+		prev[j] = noMatch
+		if eq(p[0], t[j]) {
+			prev[j] = fuzzyScoreMatch + bonus[j]*fuzzyBonusFirstCharMul
+		}
+	}
+	for i := 1; i < len(p); i++ {
+		// gap is the best score of a match of p[:i] ending before j-1,
+		// with the gap up to j penalised.
+		gap := noMatch
+		for j := range t {
+			cur[j] = noMatch
+			if j >= 2 && prev[j-2] != noMatch && prev[j-2]+fuzzyGapStart > gap {
+				gap = prev[j-2] + fuzzyGapStart
+			}
+			if eq(p[i], t[j]) && j > 0 {
+				best := gap
+				if prev[j-1] != noMatch && prev[j-1]+fuzzyBonusConsecutive > best {
+					best = prev[j-1] + fuzzyBonusConsecutive
+				}
+				if best != noMatch {
+					cur[j] = best + fuzzyScoreMatch + bonus[j]
+				}
+			}
+			if gap != noMatch {
+				gap += fuzzyGapExtension
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	best := noMatch
+	for _, score := range prev {
+		if score > best {
+			best = score
+		}
+	}
+	return best, best != noMatch
+}
+
+// fuzzyBonus is the bonus for matching t[j], based on the character before
+// it.
+func fuzzyBonus(t []rune, j int) int {
+	if j == 0 {
+		return fuzzyBonusBoundary
+	}
+	prev, r := t[j-1], t[j]
+	switch {
+	case prev == '/' || prev == '-' || prev == '_' || prev == '.' || unicode.IsSpace(prev):
+		return fuzzyBonusBoundary
+	case unicode.IsLower(prev) && unicode.IsUpper(r):
+		return fuzzyBonusCamel
+	case unicode.IsLetter(prev) && unicode.IsDigit(r):
+		return fuzzyBonusCamel
+	}
+	return 0
+}
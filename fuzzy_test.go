@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestFuzzyMatch(t *testing.T) {
+	matches := []struct {
+		Pattern, S string
+		Want       bool
+	}{
+		{"", "anything", true},
+		{"kcsrgp", "github.com/keegancsmith/rgp", true},
+		{"rgp", "github.com/keegancsmith/rgp", true},
+		{"RGP", "github.com/keegancsmith/rgp", false},
+		{"Rgp", "github.com/keegancsmith/Rgp", true},
+		{"pgr", "github.com/keegancsmith/rgp", false},
+		{"toolong", "tool", false},
+	}
+	for _, tt := range matches {
+		if _, ok := fuzzyMatch(tt.Pattern, tt.S); ok != tt.Want {
+			t.Errorf("fuzzyMatch(%q, %q) == %v != %v", tt.Pattern, tt.S, ok, tt.Want)
+		}
+	}
+
+	// Each case lists strings in the order the pattern should rank them.
+	ranks := []struct {
+		Pattern string
+		Order   []string
+	}{
+		// consecutive runs
+		{"rgp", []string{"keegancsmith/rgp", "keegancsmith/regexp"}},
+		// path segment boundaries
+		{"api", []string{"acme/api", "acme/rapid"}},
+		// camelCase humps
+		{"fb", []string{"acme/FooBar", "acme/foobar"}},
+		// shorter gaps
+		{"ab", []string{"acme/a-b", "acme/a---b"}},
+	}
+	for _, tt := range ranks {
+		prev := 0
+		for i, s := range tt.Order {
+			score, ok := fuzzyMatch(tt.Pattern, s)
+			if !ok {
+				t.Errorf("fuzzyMatch(%q, %q) did not match", tt.Pattern, s)
+				continue
+			}
+			if i > 0 && score >= prev {
+				t.Errorf("fuzzyMatch(%q, %q) == %d should score below %q (%d)", tt.Pattern, s, score, tt.Order[i-1], prev)
+			}
+			prev = score
+		}
+	}
+}
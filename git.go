@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitDir returns the git directory for the working tree at repo. It
+// understands worktrees and submodules, where .git is a file pointing to
+// the real git directory, and bare repos.
+func gitDir(repo string) (string, error) {
+	dir := filepath.Join(repo, ".git")
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) && isBareGitRepo(repo) {
+		return repo, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return dir, nil
+	}
+	b, err := ioutil.ReadFile(dir)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, "gitdir: ") {
+		return "", fmt.Errorf("%s: unexpected contents", dir)
+	}
+	dir = strings.TrimPrefix(s, "gitdir: ")
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(repo, dir)
+	}
+	return dir, nil
+}
+
+// gitHead returns the commit checked out in the git directory dir.
+func gitHead(dir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(head, "ref: ") {
+		// detached HEAD
+		return head, nil
+	}
+	return gitResolveRef(dir, strings.TrimPrefix(head, "ref: "))
+}
+
+// gitBranch returns the branch checked out in the git directory dir, or ""
+// if HEAD is detached.
+func gitBranch(dir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(head, "ref: ") {
+		return "", nil
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(head, "ref: "), "refs/heads/"), nil
+}
+
+// gitResolveRef returns the commit ref points to, looking in both loose and
+// packed refs.
+func gitResolveRef(dir, ref string) (string, error) {
+	dirs := []string{dir}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		// worktrees share refs with the main git directory
+		common := strings.TrimSpace(string(b))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(dir, common)
+		}
+		dirs = append(dirs, common)
+	}
+
+	for _, d := range dirs {
+		if b, err := ioutil.ReadFile(filepath.Join(d, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+		f, err := os.Open(filepath.Join(d, "packed-refs"))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			// lines look like "<sha> <ref>"
+			fields := strings.Fields(sc.Text())
+			if len(fields) == 2 && fields[1] == ref {
+				f.Close()
+				return fields[0], nil
+			}
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("%s: could not resolve %s", dir, ref)
+}
+
+// gitConfigPath returns the config file of the git directory dir. Worktrees
+// share the config of the main git directory.
+func gitConfigPath(dir string) string {
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(b))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(dir, common)
+		}
+		dir = common
+	}
+	return filepath.Join(dir, "config")
+}
+
+// gitConfigValue returns the value of key, eg remote.origin.url, in the git
+// config file at path. It understands the config git writes itself, but
+// does not follow includes.
+func gitConfigValue(path, key string) (string, error) {
+	i, j := strings.Index(key, "."), strings.LastIndex(key, ".")
+	if i < 0 {
+		return "", fmt.Errorf("invalid git config key %q", key)
+	}
+	section, subsection, name := key[:i], "", key[j+1:]
+	if i < j {
+		subsection = key[i+1 : j]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var (
+		value string
+		found bool
+		match bool
+	)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				return "", fmt.Errorf("%s: invalid section %q", path, line)
+			}
+			sec, sub := line[1:end], ""
+			if k := strings.Index(sec, " "); k >= 0 {
+				// [section "subsection"]
+				sec, sub = sec[:k], strings.Trim(strings.TrimSpace(sec[k:]), `"`)
+			} else if k := strings.Index(sec, "."); k >= 0 {
+				// deprecated [section.subsection]
+				sec, sub = sec[:k], strings.ToLower(sec[k+1:])
+			}
+			match = strings.EqualFold(sec, section) && sub == subsection
+			continue
+		}
+		if !match {
+			continue
+		}
+		k := strings.Index(line, "=")
+		if k < 0 {
+			// a boolean key without a value
+			if strings.EqualFold(line, name) {
+				value, found = "true", true
+			}
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(line[:k]), name) {
+			// the last value wins, like git config --get
+			value, found = gitConfigUnquote(line[k+1:]), true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("%s: %s not set", path, key)
+	}
+	return value, nil
+}
+
+// gitConfigUnquote returns the value of a config line, removing quotes,
+// escapes and trailing comments.
+func gitConfigUnquote(s string) string {
+	var (
+		b      strings.Builder
+		quoted bool
+	)
+	s = strings.TrimSpace(s)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(b.String())
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalRepoName normalises a git remote URL to host/owner/name, eg
+// git@github.com:acme/api.git becomes github.com/acme/api. It returns "" for
+// remotes which are local paths.
+func canonicalRepoName(remote string) string {
+	remote = strings.TrimSpace(remote)
+	var host, path string
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return ""
+		}
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(remote, ":"); i > 1 && !strings.Contains(remote[:i], "/") {
+		// scp-like syntax [user@]host:path. A single letter before the
+		// colon is a windows drive.
+		host, path = remote[:i], remote[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return ""
+	}
+	return strings.ToLower(host) + "/" + path
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globMatcher matches paths against a glob the way ripgrep does. A glob
+// without a slash matches the base name of a path, otherwise it matches the
+// whole path. ** matches across directories and {a,b} matches either
+// alternative.
+type globMatcher struct {
+	re       *regexp.Regexp
+	basename bool
+}
+
+func compileGlob(glob string, caseSensitive bool) (*globMatcher, error) {
+	var b strings.Builder
+	if !caseSensitive {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// **/ matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		case '{':
+			if strings.IndexByte(glob[i+1:], '}') < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			braces++
+			b.WriteString("(?:")
+		case ',':
+			if braces > 0 {
+				b.WriteString("|")
+			} else {
+				b.WriteString(",")
+			}
+		case '}':
+			if braces > 0 {
+				braces--
+				b.WriteString(")")
+			} else {
+				b.WriteString(regexp.QuoteMeta("}"))
+			}
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	return &globMatcher{
+		re:       re,
+		basename: !strings.Contains(strings.TrimPrefix(glob, "**/"), "/"),
+	}, nil
+}
+
+// Match reports whether the slash separated path p matches.
+func (g *globMatcher) Match(p string) bool {
+	if g.basename {
+		p = path.Base(p)
+	}
+	return g.re.MatchString(p)
+}
+
+// escapeGlob escapes the glob metacharacters in s, so it matches only
+// itself.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]{}\\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreRule is a pattern from a gitignore style file.
+type ignoreRule struct {
+	glob *globMatcher
+	// negated rules start with ! and re-include paths.
+	negated bool
+	// dirOnly rules end with / and only match directories.
+	dirOnly bool
+}
+
+// ignoreFile is the rules of a gitignore style file.
+type ignoreFile struct {
+	rules []ignoreRule
+}
+
+// parseIgnoreFile parses the gitignore rules in data. Invalid rules are
+// skipped, like git does.
+func parseIgnoreFile(data []byte) *ignoreFile {
+	f := &ignoreFile{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are ignored unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// A slash anywhere but the end anchors the rule to dir, otherwise
+		// it matches at any depth.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		g, err := compileGlob(line, true)
+		if err != nil {
+			continue
+		}
+		g.basename = !anchored
+		r.glob = g
+		f.rules = append(f.rules, r)
+	}
+	return f
+}
+
+// readIgnoreFile reads the ignore file path. A missing file is nil.
+func readIgnoreFile(path string) *ignoreFile {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	f := parseIgnoreFile(b)
+	if len(f.rules) == 0 {
+		return nil
+	}
+	return f
+}
+
+// match reports whether a rule matches path, and if so whether path is
+// ignored. Rules match path relative to the directory base, and the last
+// matching rule wins.
+func (f *ignoreFile) match(base, path string, isDir bool) (matched, ignored bool) {
+	if f == nil {
+		return false, false
+	}
+	if !strings.HasSuffix(base, string(filepath.Separator)) {
+		base += string(filepath.Separator)
+	}
+	if !strings.HasPrefix(path, base) {
+		return false, false
+	}
+	rel := filepath.ToSlash(path[len(base):])
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		r := f.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.glob.Match(rel) {
+			return true, !r.negated
+		}
+	}
+	return false, false
+}
+
+// The kinds of ignore files, in order of precedence.
+const (
+	rgIgnore = iota
+	dotIgnore
+	gitIgnore
+	gitExclude
+	numIgnoreKinds
+)
+
+// ignoreDir is the ignore files of a directory, linked to those of its
+// parent.
+type ignoreDir struct {
+	once   sync.Once
+	path   string
+	parent *ignoreDir
+	files  [numIgnoreKinds]*ignoreFile
+	// hasGit is true if the directory is the root of a git repo.
+	hasGit bool
+	// inGit is true if the directory or one of its parents has hasGit.
+	inGit bool
+}
+
+// ignoreTree finds the ignore files which apply to paths, the way ripgrep
+// does. Directories are loaded on first use, and can be used concurrently.
+type ignoreTree struct {
+	mu   sync.Mutex
+	dirs map[string]*ignoreDir
+}
+
+func newIgnoreTree() *ignoreTree {
+	return &ignoreTree{dirs: map[string]*ignoreDir{}}
+}
+
+// dir returns the ignore files of the absolute directory path.
+func (t *ignoreTree) dir(path string) *ignoreDir {
+	t.mu.Lock()
+	d, ok := t.dirs[path]
+	if !ok {
+		d = &ignoreDir{path: path}
+		t.dirs[path] = d
+	}
+	t.mu.Unlock()
+
+	d.once.Do(func() {
+		if parent := filepath.Dir(path); parent != path {
+			d.parent = t.dir(parent)
+		}
+		if _, err := os.Lstat(filepath.Join(path, ".git")); err == nil {
+			d.hasGit = true
+		}
+		d.inGit = d.hasGit || (d.parent != nil && d.parent.inGit)
+		d.files[rgIgnore] = readIgnoreFile(filepath.Join(path, ".rgignore"))
+		d.files[dotIgnore] = readIgnoreFile(filepath.Join(path, ".ignore"))
+		d.files[gitIgnore] = readIgnoreFile(filepath.Join(path, ".gitignore"))
+		if d.hasGit {
+			if gitdir, err := gitDir(path); err == nil {
+				d.files[gitExclude] = readIgnoreFile(filepath.Join(gitdir, "info", "exclude"))
+			}
+		}
+	})
+	return d
+}
+
+// ignored reports whether the absolute path is ignored by the ignore files
+// of its parent directories. Deeper files take precedence over shallower
+// ones, but a .rgignore anywhere takes precedence over a .ignore, which
+// takes precedence over a .gitignore. Like git, .gitignore files are only
+// used inside a git repo and not above the root of the repo.
+func (t *ignoreTree) ignored(path string, isDir bool) bool {
+	leaf := t.dir(filepath.Dir(path))
+	var (
+		matched [numIgnoreKinds]bool
+		ignored [numIgnoreKinds]bool
+		repo    *ignoreDir
+	)
+	for d := leaf; d != nil; d = d.parent {
+		for kind, f := range d.files {
+			if matched[kind] || ((kind == gitIgnore || kind == gitExclude) && (!leaf.inGit || repo != nil)) {
+				continue
+			}
+			matched[kind], ignored[kind] = f.match(d.path, path, isDir)
+		}
+		if repo == nil && d.hasGit {
+			repo = d
+		}
+	}
+	for kind := range matched {
+		if matched[kind] {
+			return ignored[kind]
+		}
+	}
+	if repo != nil {
+		if m, ign := globalGitIgnore().match(repo.path, path, isDir); m {
+			return ign
+		}
+	}
+	return false
+}
+
+var (
+	globalGitIgnoreOnce sync.Once
+	globalGitIgnoreFile *ignoreFile
+)
+
+// globalGitIgnore returns the rules of git's core.excludesFile, which
+// apply to every repo.
+func globalGitIgnore() *ignoreFile {
+	globalGitIgnoreOnce.Do(func() {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		path, err := gitConfigValue(filepath.Join(home, ".gitconfig"), "core.excludesFile")
+		if err != nil || path == "" {
+			configHome := os.Getenv("XDG_CONFIG_HOME")
+			if configHome == "" {
+				configHome = filepath.Join(home, ".config")
+			}
+			path = filepath.Join(configHome, "git", "ignore")
+		} else if strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, path[2:])
+		}
+		// Rules in the global file match relative to the root of each
+		// repo.
+		globalGitIgnoreFile = readIgnoreFile(path)
+	})
+	return globalGitIgnoreFile
+}
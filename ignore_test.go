@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestIgnoreFile(t *testing.T) {
+	f := parseIgnoreFile([]byte(`# comment
+*.o
+/root.txt
+docs/*.md
+!docs/keep.md
+out/
+\#hash
+trailing
+`))
+	cases := []struct {
+		Path    string
+		IsDir   bool
+		Matched bool
+		Ignored bool
+	}{
+		{"/repo/a.o", false, true, true},
+		{"/repo/sub/a.o", false, true, true},
+		{"/repo/root.txt", false, true, true},
+		{"/repo/sub/root.txt", false, false, false},
+		{"/repo/docs/a.md", false, true, true},
+		{"/repo/docs/keep.md", false, true, false},
+		{"/repo/sub/docs/a.md", false, false, false},
+		{"/repo/out", true, true, true},
+		{"/repo/out", false, false, false},
+		{"/repo/#hash", false, true, true},
+		{"/repo/trailing", false, true, true},
+		{"/other/a.o", false, false, false},
+	}
+	for _, tt := range cases {
+		matched, ignored := f.match("/repo", tt.Path, tt.IsDir)
+		if matched != tt.Matched || ignored != tt.Ignored {
+			t.Errorf("match(%q, %v) == %v, %v want %v, %v", tt.Path, tt.IsDir, matched, ignored, tt.Matched, tt.Ignored)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package fastwalk
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -22,8 +23,10 @@ import (
 	"sync"
 )
 
-// traverseLink is a sentinel error for fastWalk, similar to filepath.SkipDir.
-var traverseLink = errors.New("traverse symlink, assuming target is a directory")
+// ErrTraverseLink is used as a return value from WalkFuncs to indicate that
+// the symlink named in the call may be traversed. It is similar to
+// filepath.SkipDir.
+var ErrTraverseLink = errors.New("fastwalk: traverse symlink, assuming target is a directory")
 
 // Walk walks the file tree rooted at root, calling walkFn for
 // each file or directory in the tree, including root.
@@ -36,22 +39,44 @@ var traverseLink = errors.New("traverse symlink, assuming target is a directory"
 //     any permission bits.
 //   * multiple goroutines stat the filesystem concurrently. The provided
 //     walkFn must be safe for concurrent use.
-//   * fastWalk can follow symlinks if walkFn returns the traverseLink
-//     sentinel error. It is the walkFn's responsibility to prevent
-//     fastWalk from going into symlink cycles.
+//   * fastWalk can follow symlinks if walkFn returns the ErrTraverseLink
+//     sentinel error. walkFn is not called again for the target directory.
+//     It is the walkFn's responsibility to prevent fastWalk from going
+//     into symlink cycles.
 func Walk(root string, walkFn func(path string, typ os.FileMode) error) error {
-	return fastWalk(root, walkFn)
+	return WalkContext(context.Background(), root, nil, walkFn)
 }
 
-func fastWalk(root string, walkFn func(path string, typ os.FileMode) error) error {
-	// TODO(bradfitz): make numWorkers configurable? We used a
-	// minimum of 4 to give the kernel more info about multiple
-	// things we want, in hopes its I/O scheduling can take
-	// advantage of that. Hopefully most are in cache. Maybe 4 is
-	// even too low of a minimum. Profile more.
-	numWorkers := 4
-	if n := runtime.NumCPU(); n > numWorkers {
-		numWorkers = n
+// Options configures WalkContext. The zero value uses the defaults.
+type Options struct {
+	// NumWorkers is the number of goroutines reading directories. If
+	// zero, it is the number of CPUs, with a minimum of 4.
+	NumWorkers int
+
+	// MaxDepth limits how far below root the walk descends. walkFn is
+	// called for directories MaxDepth levels below root, but they are
+	// not read. Zero means no limit.
+	MaxDepth int
+}
+
+// WalkContext is like Walk, but stops reading directories and returns
+// ctx.Err() once ctx is done. walkFn is not called after WalkContext
+// returns.
+func WalkContext(ctx context.Context, root string, opts *Options, walkFn func(path string, typ os.FileMode) error) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	// We used a minimum of 4 to give the kernel more info about
+	// multiple things we want, in hopes its I/O scheduling can take
+	// advantage of that. Hopefully most are in cache. Maybe 4 is even
+	// too low of a minimum. Profile more.
+	numWorkers := opts.NumWorkers
+	if numWorkers <= 0 {
+		numWorkers = 4
+		if n := runtime.NumCPU(); n > numWorkers {
+			numWorkers = n
+		}
 	}
 
 	// Make sure to wait for all workers to finish, otherwise
@@ -62,6 +87,9 @@ func fastWalk(root string, walkFn func(path string, typ os.FileMode) error) erro
 
 	w := &walker{
 		fn:       walkFn,
+		maxDepth: opts.MaxDepth,
+		ctxDone:  ctx.Done(),
+		ctxErr:   ctx.Err,
 		enqueuec: make(chan walkItem, numWorkers), // buffered for performance
 		workc:    make(chan walkItem, numWorkers), // buffered for performance
 		donec:    make(chan struct{}),
@@ -86,6 +114,8 @@ func fastWalk(root string, walkFn func(path string, typ os.FileMode) error) erro
 			workItem = todo[len(todo)-1]
 		}
 		select {
+		case <-w.ctxDone:
+			return ctx.Err()
 		case workc <- workItem:
 			todo = todo[:len(todo)-1]
 			out++
@@ -126,14 +156,18 @@ func (w *walker) doWork(wg *sync.WaitGroup) {
 			select {
 			case <-w.donec:
 				return
-			case w.resc <- w.walk(it.dir, !it.callbackDone):
+			case w.resc <- w.walk(it):
 			}
 		}
 	}
 }
 
 type walker struct {
-	fn func(path string, typ os.FileMode) error
+	fn       func(path string, typ os.FileMode) error
+	maxDepth int
+
+	ctxDone <-chan struct{} // the walk's context.Done()
+	ctxErr  func() error
 
 	donec    chan struct{} // closed on fastWalk's return
 	workc    chan walkItem // to workers
@@ -143,6 +177,7 @@ type walker struct {
 
 type walkItem struct {
 	dir          string
+	depth        int  // levels below root
 	callbackDone bool // callback already called; don't do it again
 }
 
@@ -153,19 +188,25 @@ func (w *walker) enqueue(it walkItem) {
 	}
 }
 
-func (w *walker) onDirEnt(dirName, baseName string, typ os.FileMode) error {
+func (w *walker) onDirEnt(dirName, baseName string, typ os.FileMode, depth int) error {
+	select {
+	case <-w.ctxDone:
+		return w.ctxErr()
+	default:
+	}
+
 	joined := dirName + string(os.PathSeparator) + baseName
 	if typ == os.ModeDir {
-		w.enqueue(walkItem{dir: joined})
+		w.enqueue(walkItem{dir: joined, depth: depth})
 		return nil
 	}
 
 	err := w.fn(joined, typ)
 	if typ == os.ModeSymlink {
-		if err == traverseLink {
+		if err == ErrTraverseLink {
 			// Set callbackDone so we don't call it twice for both the
 			// symlink-as-symlink and the symlink-as-directory later:
-			w.enqueue(walkItem{dir: joined, callbackDone: true})
+			w.enqueue(walkItem{dir: joined, depth: depth, callbackDone: true})
 			return nil
 		}
 		if err == filepath.SkipDir {
@@ -176,9 +217,9 @@ func (w *walker) onDirEnt(dirName, baseName string, typ os.FileMode) error {
 	return err
 }
 
-func (w *walker) walk(root string, runUserCallback bool) error {
-	if runUserCallback {
-		err := w.fn(root, os.ModeDir)
+func (w *walker) walk(it walkItem) error {
+	if !it.callbackDone {
+		err := w.fn(it.dir, os.ModeDir)
 		if err == filepath.SkipDir {
 			return nil
 		}
@@ -187,5 +228,10 @@ func (w *walker) walk(root string, runUserCallback bool) error {
 		}
 	}
 
-	return readDir(root, w.onDirEnt)
+	if w.maxDepth > 0 && it.depth >= w.maxDepth {
+		return nil
+	}
+	return readDir(it.dir, func(dirName, entName string, typ os.FileMode) error {
+		return w.onDirEnt(dirName, entName, typ, it.depth+1)
+	})
 }
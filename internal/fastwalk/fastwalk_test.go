@@ -0,0 +1,155 @@
+package fastwalk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTree creates the files in a temporary directory, creating their
+// parent directories as needed. A path ending in / is a directory.
+func testTree(t *testing.T, files ...string) string {
+	root, err := ioutil.TempDir("", "fastwalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f))
+		if strings.HasSuffix(f, "/") {
+			err = os.MkdirAll(path, 0700)
+		} else if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			err = ioutil.WriteFile(path, nil, 0600)
+		}
+		if err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// walkPaths walks root and returns the slash separated paths walkFn was
+// called with, relative to root, with a trailing / for directories.
+func walkPaths(t *testing.T, root string, opts *Options) []string {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	err := WalkContext(context.Background(), root, opts, func(path string, typ os.FileMode) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if typ == os.ModeDir {
+			rel += "/"
+		}
+		mu.Lock()
+		paths = append(paths, rel)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestWalk(t *testing.T) {
+	root := testTree(t, "a/b/c.go", "a/d.go", "e/", "f.go")
+	defer os.RemoveAll(root)
+
+	got := walkPaths(t, root, nil)
+	want := []string{"./", "a/", "a/b/", "a/b/c.go", "a/d.go", "e/", "f.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestWalkMaxDepth(t *testing.T) {
+	root := testTree(t, "a/b/c/d.go", "a/b/e.go", "a/f.go", "g.go")
+	defer os.RemoveAll(root)
+
+	cases := []struct {
+		MaxDepth int
+		Want     []string
+	}{
+		{0, []string{"./", "a/", "a/b/", "a/b/c/", "a/b/c/d.go", "a/b/e.go", "a/f.go", "g.go"}},
+		{1, []string{"./", "a/", "g.go"}},
+		// Directories at MaxDepth are walked, but not read.
+		{2, []string{"./", "a/", "a/b/", "a/f.go", "g.go"}},
+		{3, []string{"./", "a/", "a/b/", "a/b/c/", "a/b/e.go", "a/f.go", "g.go"}},
+	}
+	for _, tt := range cases {
+		got := walkPaths(t, root, &Options{MaxDepth: tt.MaxDepth})
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("MaxDepth %d got %q want %q", tt.MaxDepth, got, tt.Want)
+		}
+	}
+}
+
+func TestWalkContextCancel(t *testing.T) {
+	var files []string
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 20; j++ {
+			files = append(files, fmt.Sprintf("d%d/d%d/", i, j))
+		}
+	}
+	root := testTree(t, files...)
+	defer os.RemoveAll(root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WalkContext(ctx, root, nil, func(string, os.FileMode) error { return nil }); err != context.Canceled {
+		t.Errorf("walk with a done context returned %v", err)
+	}
+
+	// Walking the whole tree takes several seconds, so the walk has to
+	// stop soon after it is cancelled.
+	before := runtime.NumGoroutine()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		calls    int
+		returned bool
+	)
+	start := time.Now()
+	err := WalkContext(ctx, root, &Options{NumWorkers: 2}, func(path string, typ os.FileMode) error {
+		mu.Lock()
+		calls++
+		if returned {
+			t.Errorf("walkFn called with %s after WalkContext returned", path)
+		}
+		if calls == 10 {
+			cancel()
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	mu.Lock()
+	returned = true
+	mu.Unlock()
+	if err != context.Canceled {
+		t.Errorf("cancelled walk returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled walk took %v", d)
+	}
+
+	// Every worker has exited by the time WalkContext returns.
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines leaked", n-before)
+	}
+}
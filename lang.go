@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// langAliases maps language names people commonly use to the name of the
+// ripgrep file type.
+var langAliases = map[string]string{
+	"bash":       "sh",
+	"c#":         "csharp",
+	"c++":        "cpp",
+	"golang":     "go",
+	"javascript": "js",
+	"python":     "py",
+	"shell":      "sh",
+	"typescript": "ts",
+	"yml":        "yaml",
+}
+
+var (
+	rgTypesOnce sync.Once
+	rgTypes     map[string][]string
+	rgTypesErr  error
+)
+
+// rgTypeList returns the file types ripgrep knows about, mapped to their
+// globs. It is a variable so tests do not depend on the installed ripgrep.
+var rgTypeList = func() (map[string][]string, error) {
+	rgTypesOnce.Do(func() {
+		out, err := exec.Command("rg", "--type-list").Output()
+		if e, ok := err.(*exec.Error); ok && e.Err == exec.ErrNotFound {
+			// The native engine works without ripgrep, so fall back
+			// to the common types.
+			rgTypes = builtinTypes
+			return
+		}
+		if err != nil {
+			rgTypesErr = fmt.Errorf("rg --type-list failed: %v", err)
+			return
+		}
+		rgTypes = parseTypeList(string(out))
+	})
+	return rgTypes, rgTypesErr
+}
+
+// builtinTypes are the common file types ripgrep defines, used when ripgrep
+// is not installed.
+var builtinTypes = map[string][]string{
+	"c":        {"*.[chH]", "*.[chH].in", "*.cats"},
+	"clojure":  {"*.clj", "*.cljc", "*.cljs", "*.cljx"},
+	"cpp":      {"*.[ChH]", "*.[ChH].in", "*.[ch]pp", "*.[ch]pp.in", "*.[ch]xx", "*.[ch]xx.in", "*.cc", "*.cc.in", "*.hh", "*.hh.in", "*.inl"},
+	"csharp":   {"*.cs"},
+	"css":      {"*.css", "*.scss"},
+	"dart":     {"*.dart"},
+	"docker":   {"*Dockerfile*"},
+	"elixir":   {"*.eex", "*.ex", "*.exs", "*.heex", "*.leex", "*.livemd"},
+	"erlang":   {"*.erl", "*.hrl"},
+	"go":       {"*.go"},
+	"haskell":  {"*.c2hs", "*.cpphs", "*.hs", "*.hsc", "*.lhs"},
+	"html":     {"*.ejs", "*.htm", "*.html"},
+	"java":     {"*.java", "*.jsp", "*.jspx", "*.properties"},
+	"js":       {"*.cjs", "*.js", "*.jsx", "*.mjs", "*.vue"},
+	"json":     {"*.json", "composer.lock"},
+	"kotlin":   {"*.kt", "*.kts"},
+	"lua":      {"*.lua"},
+	"make":     {"*.mak", "*.mk", "GNUmakefile", "Gnumakefile", "Makefile", "gnumakefile", "makefile"},
+	"markdown": {"*.markdown", "*.md", "*.mdown", "*.mdwn", "*.mkd", "*.mkdn", "*.mdx"},
+	"md":       {"*.markdown", "*.md", "*.mdown", "*.mdwn", "*.mkd", "*.mkdn", "*.mdx"},
+	"ocaml":    {"*.ml", "*.mli", "*.mll", "*.mly"},
+	"perl":     {"*.PL", "*.perl", "*.pl", "*.plh", "*.plx", "*.pm", "*.t"},
+	"php":      {"*.php", "*.php3", "*.php4", "*.php5", "*.php7", "*.php8", "*.pht", "*.phtml"},
+	"protobuf": {"*.proto"},
+	"py":       {"*.py", "*.pyi"},
+	"r":        {"*.R", "*.Rmd", "*.Rnw", "*.r", "*.rmd", "*.rnw"},
+	"ruby":     {"*.gemspec", "*.rb", "*.rbw", ".irbrc", "Gemfile", "config.ru"},
+	"rust":     {"*.rs"},
+	"scala":    {"*.sbt", "*.scala"},
+	"sh":       {"*.bash", "*.bashrc", "*.csh", "*.cshrc", "*.ksh", "*.kshrc", "*.sh", "*.tcsh", "*.zsh", ".bash_login", ".bash_logout", ".bash_profile", ".bashrc", ".cshrc", ".kshrc", ".login", ".logout", ".profile", ".tcshrc", ".zlogin", ".zlogout", ".zprofile", ".zshenv", ".zshrc", "bash_login", "bash_logout", "bash_profile", "bashrc", "profile", "zlogin", "zlogout", "zprofile", "zshenv", "zshrc"},
+	"sql":      {"*.psql", "*.sql"},
+	"swift":    {"*.swift"},
+	"toml":     {"*.toml", "Cargo.lock"},
+	"ts":       {"*.cts", "*.mts", "*.ts", "*.tsx"},
+	"txt":      {"*.txt"},
+	"xml":      {"*.dtd", "*.rng", "*.sch", "*.xjb", "*.xml", "*.xml.dist", "*.xsd", "*.xsl", "*.xslt"},
+	"yaml":     {"*.yaml", "*.yml"},
+}
+
+// parseTypeList parses the output of rg --type-list, which looks like
+//
+//	go: *.go
+//	py: *.py, *.pyi
+func parseTypeList(out string) map[string][]string {
+	types := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		var globs []string
+		for _, g := range strings.Split(line[i+1:], ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				globs = append(globs, g)
+			}
+		}
+		types[line[:i]] = globs
+	}
+	return types
+}
+
+// languageGlobs returns the globs matching files of language lang.
+func languageGlobs(lang string) ([]string, error) {
+	name, err := resolveLanguage(lang)
+	if err != nil {
+		return nil, err
+	}
+	types, err := rgTypeList()
+	return types[name], err
+}
+
+// resolveLanguage returns the ripgrep file type for lang.
+func resolveLanguage(lang string) (string, error) {
+	types, err := rgTypeList()
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.ToLower(lang)
+	if alias, ok := langAliases[name]; ok {
+		name = alias
+	}
+	if _, ok := types[name]; !ok {
+		return "", fmt.Errorf("unknown language %q, see rg --type-list", lang)
+	}
+	return name, nil
+}
+
+// languages returns the names which can be used with lang:.
+func languages() []string {
+	types, _ := rgTypeList()
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -11,24 +15,50 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	prompt "github.com/c-bata/go-prompt"
 	"github.com/google/zoekt/query"
-	"github.com/keegancsmith/rgp/internal/fastwalk"
 )
 
 const debug = false
 
-func ripgrep(q query.Q) ([]string, error) {
+// rgRun is a single ripgrep invocation, along with the filtering rgp needs
+// to do on its output.
+type rgRun struct {
+	Args []string
+
+	// FileArgs are the arguments for ripgrep runs which list files. Only
+	// files listed by every run are searched. This is used by file scope
+	// to find the files which contain every term.
+	FileArgs [][]string
+
+	// Include are regexes which matching lines must also match. This is
+	// used when ripgrep can not express the whole query.
+	Include []string
+
+	// Exclude are the negated content atoms, each as regexes which all
+	// match a line containing the atom. Lines matching every regex of an
+	// atom are removed from the output, or with file scope the files
+	// containing a match for every regex are removed.
+	Exclude [][]string
+}
+
+func ripgrep(q query.Q, opts searchOptions) (*rgRun, error) {
 	// Q is fully hierarchical with many token types, but we are only
-	// supporting a very flat limited subset of that.
+	// supporting a limited subset of that. Globs and languages must be at
+	// the top level (splitOr ensures this), while content atoms can be
+	// combined with and/or.
 	and, ok := q.(*query.And)
 	if !ok {
 		and = &query.And{Children: []query.Q{q}}
 	}
 
 	var args []string
-	var reParts []*syntax.Regexp
+	var content, negated []query.Q
+	// lang is the file type of the first lang: atom, and langName how it
+	// was written.
+	var lang, langName string
 	for _, q := range and.Children {
 		isNot := false
 		if s, ok := q.(*query.Not); ok {
@@ -47,108 +77,823 @@ func ripgrep(q query.Q) ([]string, error) {
 			} else {
 				args = append(args, "--iglob", pattern)
 			}
-		case *query.Substring:
-			if s.FileName {
-				return nil, fmt.Errorf("Unexpected file substr filter")
-			}
-			if isNot {
-				return nil, fmt.Errorf("Do not support negative pattern matches")
-			}
-			re, err := syntax.Parse(regexp.QuoteMeta(s.Pattern), syntax.PerlX|syntax.UnicodeGroups)
+		case *query.Language:
+			name, err := resolveLanguage(s.Language)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
-			if !s.CaseSensitive {
-				re.Flags = re.Flags | syntax.FoldCase
+			if isNot {
+				args = append(args, "-T", name)
+				break
 			}
-			reParts = append(reParts, re)
-		case *query.Regexp:
-			if s.FileName {
-				return nil, fmt.Errorf("Unexpected file regexp filter")
+			// ripgrep matches files of any --type given, while a
+			// file only has one language.
+			if lang == "" {
+				args = append(args, "--type", name)
+				lang, langName = name, s.Language
+			} else if name != lang {
+				return nil, fmt.Errorf("lang:%s and lang:%s can not both match a file", langName, s.Language)
 			}
+		case *query.Substring, *query.Regexp, *query.And, *query.Or:
 			if isNot {
-				return nil, fmt.Errorf("Do not support negative pattern matches")
-			}
-			re := s.Regexp
-			if !s.CaseSensitive {
-				re.Flags = re.Flags | syntax.FoldCase
+				negated = append(negated, q)
+			} else {
+				content = append(content, q)
 			}
-			reParts = append(reParts, re)
 		default:
 			return nil, fmt.Errorf("Unexpected query type %T", q)
 		}
 	}
 
-	if len(reParts) == 0 {
+	if len(content) == 0 && len(negated) > 0 {
+		// Only negated patterns, which ripgrep can do by itself unless
+		// they have too many terms to permute.
+		var patterns [][]query.Q
+		var exclude []query.Q
+		for _, q := range negated {
+			// ripgrep matches a pattern on a line, while the terms
+			// of a negated and match anywhere in a file with
+			// scope:file.
+			if hasManyTerms(q, opts.Ordered) || (opts.FileScope && hasAnd(q)) {
+				exclude = append(exclude, q)
+			} else {
+				patterns = append(patterns, []query.Q{q})
+			}
+		}
+		run := &rgRun{}
+		if len(patterns) == 0 {
+			// We remove lines or files ourselves, so ripgrep lists
+			// them all.
+			if opts.FileScope {
+				args = append(args, "--files")
+			} else {
+				args = append(args, "-e", "")
+			}
+		} else {
+			if opts.FileScope {
+				args = append(args, "--files-without-match")
+			} else {
+				args = append(args, "-v")
+			}
+			patternArgs, err := ripgrepPatterns(patterns, opts.Ordered)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, patternArgs...)
+		}
+		run.Args = args
+		var err error
+		run.Exclude, err = excludePatterns(exclude, opts)
+		if err != nil {
+			return nil, err
+		}
+		return run, nil
+	}
+
+	if len(content) == 0 {
 		// No regexes specified, so return matching files
 		args = append(args, "--files")
-		return args, nil
+		return &rgRun{Args: args}, nil
+	}
+
+	// A top-level or is passed to ripgrep as multiple patterns, which
+	// is easier to read than one large alternation.
+	var (
+		patterns [][]query.Q
+		include  bool
+		fileArgs []query.Q
+	)
+	if or, ok := content[0].(*query.Or); ok && len(content) == 1 {
+		for _, q := range or.Children {
+			patterns = append(patterns, []query.Q{q})
+		}
+	} else if opts.FileScope && len(content) > 1 {
+		// Each term needs to match somewhere in the file. We print
+		// the lines matching any term.
+		for _, q := range content {
+			patterns = append(patterns, []query.Q{q})
+		}
+		fileArgs = content
+	} else if opts.Ordered || len(content) == 1 {
+		patterns = [][]query.Q{content}
+	} else if len(content) <= maxPermutedTerms {
+		patterns = permutations(content)
+	} else {
+		// Too many permutations, so we get ripgrep to find lines
+		// matching any term and check the rest ourselves.
+		for _, q := range content {
+			patterns = append(patterns, []query.Q{q})
+		}
+		include = true
+	}
+	// An and nested in an or with too many terms to permute matches lines
+	// containing any of its terms, so we check the rest ourselves too.
+	include = include || (!opts.FileScope && hasManyTerms(&query.And{Children: content}, opts.Ordered))
+	patternArgs, err := ripgrepPatterns(patterns, opts.Ordered)
+	if err != nil {
+		return nil, err
+	}
+	run := &rgRun{Args: append(args, patternArgs...)}
+
+	for _, q := range fileArgs {
+		// A term with too many terms to permute is split into terms
+		// which each have to match somewhere in the file.
+		for _, clause := range termClauses(q, opts.Ordered) {
+			patternArgs, err := ripgrepPatterns([][]query.Q{{clause}}, opts.Ordered)
+			if err != nil {
+				return nil, err
+			}
+			run.FileArgs = append(run.FileArgs, concat(args, []string{"--files-with-matches"}, patternArgs))
+		}
+	}
+	if include {
+		var clauses [][]query.Q
+		for _, clause := range termClauses(&query.And{Children: content}, opts.Ordered) {
+			clauses = append(clauses, []query.Q{clause})
+		}
+		run.Include, err = filterPatterns(clauses, opts.Ordered)
+		if err != nil {
+			return nil, err
+		}
+	}
+	run.Exclude, err = excludePatterns(negated, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// maxPermutedTerms is the most terms we will match in any order by
+// generating a pattern for each permutation of the terms.
+const maxPermutedTerms = 3
+
+// hasManyTerms returns true if q contains an and with more terms than we
+// permute. The regex contentRegexp returns for such an and matches lines
+// containing any of its terms, so lines have to be checked with the regexes
+// from termClauses as well.
+func hasManyTerms(q query.Q, ordered bool) bool {
+	if ordered {
+		return false
+	}
+	switch s := q.(type) {
+	case *query.And:
+		if len(s.Children) > maxPermutedTerms {
+			return true
+		}
+		for _, q := range s.Children {
+			if hasManyTerms(q, ordered) {
+				return true
+			}
+		}
+	case *query.Or:
+		for _, q := range s.Children {
+			if hasManyTerms(q, ordered) {
+				return true
+			}
+		}
+	case *query.Not:
+		return hasManyTerms(s.Child, ordered)
+	}
+	return false
+}
+
+// termClauses returns queries which all match a line if q does. Ands with
+// too many terms to permute are split into their terms, so each clause can
+// be converted into a regex of a reasonable size. Like the terms of a long
+// query, the terms no longer have to match without overlapping.
+func termClauses(q query.Q, ordered bool) []query.Q {
+	return splitClauses(q, func(q query.Q) bool { return hasManyTerms(q, ordered) })
+}
+
+// fileClauses returns queries which all match a file if q does, when each
+// term only has to match somewhere in the file like with scope:file. Every
+// and is split into its terms.
+func fileClauses(q query.Q) []query.Q {
+	return splitClauses(q, hasAnd)
+}
+
+// hasAnd returns true if q contains an and.
+func hasAnd(q query.Q) bool {
+	found := false
+	query.Map(q, func(q query.Q) query.Q {
+		if _, ok := q.(*query.And); ok {
+			found = true
+		}
+		return q
+	})
+	return found
+}
+
+// splitClauses splits q into clauses which all match if q does. The ands
+// in q for which split returns true are split into their terms.
+func splitClauses(q query.Q, split func(query.Q) bool) []query.Q {
+	if !split(q) {
+		return []query.Q{q}
+	}
+	switch s := q.(type) {
+	case *query.And:
+		var clauses []query.Q
+		for _, q := range s.Children {
+			clauses = append(clauses, splitClauses(q, split)...)
+		}
+		return clauses
+	case *query.Or:
+		// (a and b) or c is (a or c) and (b or c).
+		clauses := [][]query.Q{nil}
+		for _, q := range s.Children {
+			var next [][]query.Q
+			for _, prev := range clauses {
+				for _, clause := range splitClauses(q, split) {
+					next = append(next, append(prev[:len(prev):len(prev)], clause))
+				}
+			}
+			clauses = next
+		}
+		var or []query.Q
+		for _, children := range clauses {
+			if len(children) == 1 {
+				or = append(or, children[0])
+			} else {
+				or = append(or, &query.Or{Children: children})
+			}
+		}
+		return or
+	}
+	return []query.Q{q}
+}
+
+// excludePatterns returns the Exclude regexes of an rgRun for the negated
+// content atoms negated. With scope:file the terms of a negated and only
+// have to match somewhere in a file, so ands are always split.
+func excludePatterns(negated []query.Q, opts searchOptions) ([][]string, error) {
+	var exclude [][]string
+	for _, q := range negated {
+		clauses := termClauses(q, opts.Ordered)
+		if opts.FileScope {
+			clauses = fileClauses(q)
+		}
+		var patterns [][]query.Q
+		for _, clause := range clauses {
+			patterns = append(patterns, []query.Q{clause})
+		}
+		res, err := filterPatterns(patterns, opts.Ordered)
+		if err != nil {
+			return nil, err
+		}
+		exclude = append(exclude, res)
+	}
+	return exclude, nil
+}
+
+// ripgrepPatterns returns the ripgrep flags to match any of patterns. Each
+// pattern is a sequence of terms to match in order.
+func ripgrepPatterns(patterns [][]query.Q, ordered bool) ([]string, error) {
+	ignoreCase, res, err := contentPatterns(patterns, ordered)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if ignoreCase {
+		args = append(args, "-i")
+	}
+	for _, re := range res {
+		args = append(args, "-e", re)
+	}
+	return args, nil
+}
+
+// filterPatterns is like ripgrepPatterns, but returns standalone regexes
+// for rgp to match against output lines.
+func filterPatterns(patterns [][]query.Q, ordered bool) ([]string, error) {
+	ignoreCase, res, err := contentPatterns(patterns, ordered)
+	if err != nil {
+		return nil, err
+	}
+	if ignoreCase {
+		for i := range res {
+			res[i] = "(?i)" + res[i]
+		}
+	}
+	return res, nil
+}
+
+// contentPatterns returns a regex for each of patterns. If ignoreCase is
+// true the regexes should be matched case insensitively.
+func contentPatterns(patterns [][]query.Q, ordered bool) (ignoreCase bool, res []string, err error) {
+	var reParts, leaves []*syntax.Regexp
+	for _, terms := range patterns {
+		re, err := joinRegexp(terms, ordered, &leaves)
+		if err != nil {
+			return false, nil, err
+		}
+		reParts = append(reParts, re)
 	}
 
 	// We simplify case insensitive regexes by removing the regex flag and
 	// adding a ripgrep flag. This is done so we create readable
 	// regexes. However, it doesn't effect correctness.
-	caseInsensitive := true
-	for _, re := range reParts {
-		caseInsensitive = caseInsensitive && (re.Flags&syntax.FoldCase != 0)
+	ignoreCase = true
+	for _, re := range leaves {
+		ignoreCase = ignoreCase && (re.Flags&syntax.FoldCase != 0)
 	}
-	if caseInsensitive {
-		args = append(args, "-i")
-		for _, re := range reParts {
+	if ignoreCase {
+		for _, re := range leaves {
 			re.Flags = re.Flags &^ syntax.FoldCase
 		}
 	}
 
+	for _, re := range reParts {
+		res = append(res, regexpString(re.Simplify()))
+	}
+	return ignoreCase, res, nil
+}
+
+// contentRegexp converts a query consisting only of content atoms into a
+// regex. The regexes for each atom are appended to leaves. If ordered is
+// false, the children of an and may match in any order.
+func contentRegexp(q query.Q, ordered bool, leaves *[]*syntax.Regexp) (*syntax.Regexp, error) {
+	switch s := q.(type) {
+	case *query.Substring:
+		if s.FileName {
+			return nil, fmt.Errorf("Unexpected file substr filter")
+		}
+		re, err := syntax.Parse(regexp.QuoteMeta(s.Pattern), syntax.PerlX|syntax.UnicodeGroups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !s.CaseSensitive {
+			re.Flags = re.Flags | syntax.FoldCase
+		}
+		*leaves = append(*leaves, re)
+		return re, nil
+	case *query.Regexp:
+		if s.FileName {
+			return nil, fmt.Errorf("Unexpected file regexp filter")
+		}
+		re := s.Regexp
+		if !s.CaseSensitive {
+			re.Flags = re.Flags | syntax.FoldCase
+		}
+		*leaves = append(*leaves, re)
+		return re, nil
+	case *query.And:
+		if ordered {
+			return joinRegexp(s.Children, ordered, leaves)
+		}
+		alt := &syntax.Regexp{Op: syntax.OpAlternate}
+		if len(s.Children) > maxPermutedTerms {
+			// Too many permutations, so we match any term. See
+			// hasManyTerms.
+			for _, q := range s.Children {
+				re, err := contentRegexp(q, ordered, leaves)
+				if err != nil {
+					return nil, err
+				}
+				alt.Sub = append(alt.Sub, re)
+			}
+			return alt, nil
+		}
+		for _, terms := range permutations(s.Children) {
+			re, err := joinRegexp(terms, ordered, leaves)
+			if err != nil {
+				return nil, err
+			}
+			alt.Sub = append(alt.Sub, re)
+		}
+		return alt, nil
+	case *query.Or:
+		alt := &syntax.Regexp{Op: syntax.OpAlternate}
+		for _, q := range s.Children {
+			re, err := contentRegexp(q, ordered, leaves)
+			if err != nil {
+				return nil, err
+			}
+			alt.Sub = append(alt.Sub, re)
+		}
+		return alt, nil
+	case *query.Not:
+		return nil, fmt.Errorf("Do not support negative pattern matches")
+	default:
+		return nil, fmt.Errorf("Unexpected query type %T", q)
+	}
+}
+
+// joinRegexp returns a regex matching terms in order.
+func joinRegexp(terms []query.Q, ordered bool, leaves *[]*syntax.Regexp) (*syntax.Regexp, error) {
+	if len(terms) == 1 {
+		return contentRegexp(terms[0], ordered, leaves)
+	}
+
 	// Join up the regexp
-	var joined *syntax.Regexp
 	sep, err := syntax.Parse(".*?", syntax.PerlX|syntax.UnicodeGroups)
 	if err != nil {
 		log.Fatal(err)
 	}
-	joined = &syntax.Regexp{Op: syntax.OpConcat}
-	for i, re := range reParts {
+	joined := &syntax.Regexp{Op: syntax.OpConcat}
+	for i, q := range terms {
+		re, err := contentRegexp(q, ordered, leaves)
+		if err != nil {
+			return nil, err
+		}
 		if i != 0 {
 			joined.Sub = append(joined.Sub, sep, re)
 		} else {
 			joined.Sub = append(joined.Sub, re)
 		}
 	}
-	joined = joined.Simplify()
+	return joined, nil
+}
 
-	// OpAnyCharNotNL is written as (?-s:.) which is unneccessary
-	reStr := strings.Replace(joined.String(), "(?-s:.)", ".", -1)
+// permutations returns every ordering of qs.
+func permutations(qs []query.Q) [][]query.Q {
+	if len(qs) <= 1 {
+		return [][]query.Q{qs}
+	}
+	var perms [][]query.Q
+	for i, q := range qs {
+		rest := append(qs[:i:i], qs[i+1:]...)
+		for _, perm := range permutations(rest) {
+			perms = append(perms, append([]query.Q{q}, perm...))
+		}
+	}
+	return perms
+}
 
-	args = append(args, "-e", reStr)
-	return args, nil
+// regexpString returns re in a form suitable for passing to ripgrep.
+func regexpString(re *syntax.Regexp) string {
+	// OpAnyCharNotNL is written as (?-s:.) which is unneccessary. Newer
+	// versions of Go instead wrap the whole regex in (?-s:...).
+	s := strings.Replace(re.String(), "(?-s:.)", ".", -1)
+	if strings.HasPrefix(s, "(?-s:") && groupEnd(s) == len(s)-1 {
+		s = s[len("(?-s:") : len(s)-1]
+	}
+	return s
 }
 
+// groupEnd returns the index of the parenthesis closing the group opened at
+// the start of the regex s, or -1.
+func groupEnd(s string) int {
+	depth := 0
+	inClass := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitOr splits q into queries which can each be translated into a single
+// ripgrep invocation. ripgrep can only express alternation within a
+// pattern, so an or involving file globs or languages is split into
+// separate searches.
+func splitOr(q query.Q) []query.Q {
+	switch s := q.(type) {
+	case *query.Or:
+		if !hasFileFilter(s) {
+			return []query.Q{s}
+		}
+		var content, qs []query.Q
+		for _, ch := range s.Children {
+			if hasFileFilter(ch) {
+				qs = append(qs, splitOr(ch)...)
+			} else {
+				content = append(content, ch)
+			}
+		}
+		if len(content) > 0 {
+			qs = append([]query.Q{query.Simplify(&query.Or{Children: content})}, qs...)
+		}
+		return qs
+
+	case *query.And:
+		// Distribute the and over any split children.
+		qs := [][]query.Q{nil}
+		for _, ch := range s.Children {
+			var next [][]query.Q
+			for _, prev := range qs {
+				for _, sub := range splitOr(ch) {
+					next = append(next, append(prev[:len(prev):len(prev)], sub))
+				}
+			}
+			qs = next
+		}
+		var split []query.Q
+		for _, children := range qs {
+			split = append(split, query.Simplify(&query.And{Children: children}))
+		}
+		return split
+
+	case *query.Not:
+		// Push the negation down using De Morgan's laws.
+		switch ch := s.Child.(type) {
+		case *query.And:
+			if hasFileFilter(ch) {
+				return splitOr(&query.Or{Children: negateAll(ch.Children)})
+			}
+		case *query.Or:
+			if hasFileFilter(ch) {
+				return splitOr(&query.And{Children: negateAll(ch.Children)})
+			}
+		case *query.Not:
+			return splitOr(ch.Child)
+		}
+	}
+	return []query.Q{q}
+}
+
+func negateAll(qs []query.Q) []query.Q {
+	neg := make([]query.Q, len(qs))
+	for i, q := range qs {
+		neg[i] = &query.Not{Child: q}
+	}
+	return neg
+}
+
+// hasFileFilter returns true if q contains an atom which ripgrep
+// implements by filtering the files it searches.
+func hasFileFilter(q query.Q) bool {
+	hasFilter := false
+	query.VisitAtoms(q, func(q query.Q) {
+		switch q.(type) {
+		case *query.Glob, *query.Language:
+			hasFilter = true
+		}
+	})
+	return hasFilter
+}
+
+// ripgrepRuns returns each ripgrep invocation required to evaluate q.
+func ripgrepRuns(q query.Q, opts searchOptions) ([]*rgRun, error) {
+	var runs []*rgRun
+	for _, q := range splitOr(q) {
+		run, err := ripgrep(q, opts)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// hasRepoQuery returns true if q has atoms which are evaluated per repo,
+// ie repo:, repogroup: and vcs:.
 func hasRepoQuery(q query.Q) bool {
 	hasRepo := false
 	query.VisitAtoms(q, func(q query.Q) {
-		if _, ok := q.(*query.Repo); ok {
+		switch q.(type) {
+		case *query.Repo, *repoGroupQuery, *vcsQuery:
 			hasRepo = true
 		}
 	})
 	return hasRepo
 }
 
-func simplifyRepoQuery(q query.Q, repo string) query.Q {
+func simplifyRepoQuery(q query.Q, rp repoPath) query.Q {
 	return query.Simplify(query.Map(q, func(q query.Q) query.Q {
-		if r, ok := q.(*query.Repo); ok {
-			return &query.Const{Value: strings.Contains(repo, r.Pattern)}
+		switch s := q.(type) {
+		case *query.Repo:
+			return &query.Const{Value: cachedRepoMatcher(s.Pattern).MatchRepo(rp)}
+		case *vcsQuery:
+			return &query.Const{Value: rp.VCS == s.VCS}
+		case *repoGroupQuery:
+			return &query.Const{Value: s.Group.Match(rp)}
 		}
 		return q
 	}))
 }
 
-func runrg(args []string) int {
+// repoPlan is the query to run over a set of repos, once the repo atoms
+// have been evaluated.
+type repoPlan struct {
+	Query query.Q
+	Repos []repoPath
+}
+
+// planRepos evaluates the repo atoms of q against each repo, and groups the
+// repos by the query that remains. Repos which can't match are dropped.
+// Plans are ordered by the first repo in each.
+func planRepos(q query.Q, repos <-chan repoPath) ([]*repoPlan, error) {
+	var plans []*repoPlan
+	byQuery := map[string]*repoPlan{}
+	for rp := range repos {
+		if rp.Err != nil {
+			return nil, rp.Err
+		}
+		q2 := simplifyRepoQuery(q, rp)
+		if c, ok := q2.(*query.Const); ok && !c.Value {
+			continue
+		}
+		key := q2.String()
+		p, ok := byQuery[key]
+		if !ok {
+			p = &repoPlan{Query: q2}
+			byQuery[key] = p
+			plans = append(plans, p)
+		}
+		p.Repos = append(p.Repos, rp)
+	}
+	return plans, nil
+}
+
+// searchOptions are settings which apply to the whole query. They are
+// specified as rgp specific atoms in the query, eg scope:file.
+type searchOptions struct {
+	// FileScope is true if terms should match anywhere in a file instead
+	// of on the same line. Negated atoms exclude whole files.
+	FileScope bool
+
+	// Ordered is true if the terms of a query must match in the order
+	// they are written.
+	Ordered bool
+}
+
+// parseQuery parses s into a simplified query and the options it
+// specifies.
+func parseQuery(s string) (query.Q, searchOptions, error) {
+	q, opts, err := parseQueryTree(s)
+	if err != nil {
+		return nil, opts, err
+	}
+	return query.Simplify(q), opts, nil
+}
+
+// parseQueryTree is like parseQuery, but returns the query as parsed,
+// before it is simplified.
+func parseQueryTree(s string) (query.Q, searchOptions, error) {
+	var opts searchOptions
+	q, err := query.Parse(s)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	// The zoekt parser does not know about our atoms, so they are parsed
+	// as substrings or regexes. rev: is an alias for branch:.
+	q = query.Map(q, func(q query.Q) query.Q {
+		if err != nil {
+			return q
+		}
+		var text string
+		switch s := q.(type) {
+		case *query.Substring:
+			if s.FileName || s.Content {
+				return q
+			}
+			text = s.Pattern
+		case *query.Regexp:
+			if s.FileName || s.Content {
+				return q
+			}
+			text = regexpString(s.Regexp)
+		default:
+			return q
+		}
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return q
+		}
+		switch kw, arg := text[:i], text[i+1:]; kw {
+		case "scope":
+			switch arg {
+			case "line":
+				opts.FileScope = false
+			case "file":
+				opts.FileScope = true
+			default:
+				err = fmt.Errorf("unknown scope argument %q, want {line,file}", arg)
+			}
+		case "repogroup":
+			var g *repoGroupQuery
+			g, err = parseRepoGroup(arg)
+			if err != nil {
+				return q
+			}
+			return g
+		case "vcs":
+			vcs := strings.ToLower(arg)
+			if !isVCSName(vcs) {
+				err = fmt.Errorf("unknown vcs argument %q, want {%s}", arg, strings.Join(vcsNames(), ","))
+			}
+			return &vcsQuery{VCS: vcs}
+		case "rev":
+			if arg == "" {
+				err = fmt.Errorf("the rev: atom must have an argument")
+			}
+			return &query.Branch{Pattern: arg}
+		case "order":
+			switch arg {
+			case "yes":
+				opts.Ordered = true
+			case "no":
+				opts.Ordered = false
+			default:
+				err = fmt.Errorf("unknown order argument %q, want {yes,no}", arg)
+			}
+		default:
+			return q
+		}
+		return &query.Const{Value: true}
+	})
+	if err != nil {
+		return nil, opts, err
+	}
+
+	query.VisitAtoms(q, func(q query.Q) {
+		if r, ok := q.(*query.Repo); ok && err == nil {
+			_, err = compileRepoPattern(r.Pattern)
+		}
+	})
+	if err != nil {
+		return nil, opts, err
+	}
+
+	return q, opts, nil
+}
+
+// runrg runs ripgrep with args followed by paths, writing its output to w
+// and its errors to errw. If paths do not fit on one command line they are
+// split over several runs of ripgrep, one after the other so the output
+// stays in order.
+func runrg(args, paths []string, w, errw io.Writer) int {
+	code := 1
+	for _, batch := range batchPaths(args, paths) {
+		code = combineExitStatus(code, execrg(args, batch, w, errw))
+	}
+	return code
+}
+
+// execrg runs ripgrep once with args followed by paths. If the command line
+// is still too long, such as when the environment grows, paths are split in
+// half.
+func execrg(args, paths []string, w, errw io.Writer) int {
 	if debug {
-		log.Println(args)
+		log.Println(concat(args, paths))
 	}
-	cmd := exec.Command("rg", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if explain {
+		explainCommand("rg", concat(args, paths))
+		return 0
+	}
+	cmd := exec.Command("rg", concat(args, paths)...)
+	cmd.Stdout = w
+	cmd.Stderr = errw
 	err := cmd.Run()
+	if errors.Is(err, syscall.E2BIG) && len(paths) > 1 {
+		if flag, ok := wholeRunFlag(args); ok {
+			fmt.Fprintf(errw, "rgp: too many paths for one ripgrep run, %s applies to each run\n", flag)
+		}
+		half := len(paths) / 2
+		return combineExitStatus(execrg(args, paths[:half], w, errw), execrg(args, paths[half:], w, errw))
+	}
+	return exitStatus(err)
+}
+
+// runrgJSON runs ripgrep with args and --json over repo, or the working
+// directory if repo is empty, and writes the results to w with f. Errors are
+// written to errw.
+func runrgJSON(args []string, repo string, f formatter, w, errw io.Writer) int {
+	var paths []string
+	if repo != "" {
+		paths = []string{repo}
+	}
+	args = concat(args, []string{"--json"})
+	if explain {
+		return runrg(args, paths, w, errw)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- formatRgJSON(pr, repo, f, w)
+	}()
+	code := runrg(args, paths, pw, errw)
+	pw.Close()
+	if err := <-done; err != nil {
+		fmt.Fprintf(errw, "rgp: %v\n", err)
+		return 2
+	}
+	return code
+}
+
+// rgOutput is like runrg, but returns what ripgrep wrote to stdout.
+func rgOutput(args, paths []string, errw io.Writer) ([]byte, int) {
+	var buf bytes.Buffer
+	code := runrg(args, paths, &buf, errw)
+	return buf.Bytes(), code
+}
+
+func exitStatus(err error) int {
 	if err != nil {
 		if e, ok := err.(*exec.ExitError); ok {
 			if ws, ok := e.Sys().(syscall.WaitStatus); ok {
@@ -160,6 +905,280 @@ func runrg(args []string) int {
 	return 0
 }
 
+// combineExitStatus combines the exit codes of two ripgrep runs: 2 if
+// either failed, otherwise 0 if either matched.
+func combineExitStatus(a, b int) int {
+	switch {
+	case a == 2 || b == 2:
+		return 2
+	case a == 0 || b == 0:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// search runs the ripgrep invocations for q over repos. If repos is empty
+// ripgrep searches the working directory.
+func search(passthrough []string, q query.Q, opts searchOptions, repos []repoPath) int {
+	if hasBranchQuery(q) {
+		revs, q, err := splitBranchQuery(q)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(passthrough) > 0 {
+			log.Println("ignoring ripgrep flags when searching a branch")
+		}
+		return searchBranches(os.Stdout, q, revs, opts, repos)
+	}
+
+	// Bare repos have no working tree to search, so we search their HEAD
+	// instead.
+	var trees, bare []repoPath
+	for _, rp := range repos {
+		if rp.Bare {
+			bare = append(bare, rp)
+		} else {
+			trees = append(trees, rp)
+		}
+	}
+	if len(bare) == 0 || hasSymbolQuery(q) {
+		return searchTrees(passthrough, q, opts, repos)
+	}
+	code := searchBranches(os.Stdout, q, []string{"HEAD"}, opts, bare)
+	if len(trees) > 0 {
+		code = combineExitStatus(code, searchTrees(passthrough, q, opts, trees))
+	}
+	return code
+}
+
+// searchTrees searches the working trees of repos. If repos is empty
+// ripgrep searches the working directory.
+func searchTrees(passthrough []string, q query.Q, opts searchOptions, repos []repoPath) int {
+	var paths []string
+	for _, rp := range repos {
+		paths = append(paths, rp.Path)
+	}
+
+	if hasSymbolQuery(q) {
+		if explain {
+			explainf("search the symbol index of %s", strings.Join(paths, " "))
+			return 0
+		}
+		code, err := searchSymbols(os.Stdout, q, paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return code
+	}
+
+	runs, err := ripgrepRuns(q, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].filtered() {
+		passthrough = withoutOutputFlags(passthrough)
+	}
+
+	// rg globs apply to every path searched, so repos containing nested
+	// repos we also search are searched on their own, excluding the
+	// nested repos.
+	searched := map[string]bool{}
+	for _, path := range paths {
+		searched[path] = true
+	}
+	type group struct {
+		excludes []string
+		paths    []string
+	}
+	// Repos are searched in walk order, so only consecutive repos without
+	// nested repos to exclude share a group.
+	var groups []*group
+	for _, rp := range repos {
+		var excludes []string
+		for _, child := range rp.Children {
+			if path := filepath.Join(rp.Path, child); searched[path] {
+				excludes = append(excludes, "-g", excludeGlob(path))
+			}
+		}
+		if n := len(groups); n > 0 && len(excludes) == 0 && len(groups[n-1].excludes) == 0 {
+			groups[n-1].paths = append(groups[n-1].paths, rp.Path)
+			continue
+		}
+		groups = append(groups, &group{excludes: excludes, paths: []string{rp.Path}})
+	}
+	if len(groups) == 0 {
+		return searchPaths(passthrough, runs, opts, nil, nil)
+	}
+	code := 1
+	for _, g := range groups {
+		code = combineExitStatus(code, searchPaths(passthrough, runs, opts, g.excludes, g.paths))
+	}
+	return code
+}
+
+// excludeGlob returns the ripgrep glob which excludes the directory path.
+// ripgrep roots globs at the working directory, so paths outside of it are
+// matched in full.
+func excludeGlob(path string) string {
+	if filepath.IsAbs(path) {
+		if cwd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(cwd, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				path = rel
+			}
+		}
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	if strings.HasPrefix(path, "/") {
+		return "!**" + escapeGlob(path)
+	}
+	return "!/" + escapeGlob(path)
+}
+
+// searchPaths runs the ripgrep invocations runs over paths. excludes are
+// extra ripgrep globs, passed after the globs of each run so they take
+// precedence. When searching several paths they are searched in batches by
+// searchRepos.
+func searchPaths(passthrough []string, runs []*rgRun, opts searchOptions, excludes, paths []string) int {
+	// ripgrep flags could change what matches, so indexes are only used
+	// without them. If any path is indexed every path is searched with an
+	// indexBackend, so the results of all of them are printed the same
+	// way.
+	indexed := len(passthrough) == 0 && hasTrigramIndex(paths)
+	newBackend := func(paths []string, errw io.Writer) backend {
+		var b backend = &rgBackend{passthrough: passthrough, excludes: excludes, stderr: errw}
+		if nativeEngine {
+			b = &nativeBackend{excludes: excludes, stderr: errw}
+		}
+		if indexed {
+			b = &indexBackend{excludes: excludes, fallback: b}
+		}
+		return b
+	}
+	var args []string
+	if len(runs) == 1 {
+		args = concat(passthrough, runs[0].Args, excludes)
+	}
+
+	tty := isTerminal(os.Stdout)
+	// When searching several paths ripgrep writes to a pipe, so we ask
+	// for the output it would write to a terminal.
+	var ttyArgs []string
+	if tty && len(paths) > 1 {
+		ttyArgs = []string{"--color=always", "--heading", "--line-number"}
+	}
+
+	// search searches paths, or the working directory if paths is empty.
+	// Only paths which ripgrep prints the results of are searched
+	// together.
+	search := func(paths []string, w, errw io.Writer) int {
+		b := newBackend(paths, errw)
+		switch choosePrinter(b, runs, args) {
+		case printRg:
+			// passthrough comes after ttyArgs so it can still change
+			// them.
+			return runrg(concat(ttyArgs, args), paths, w, errw)
+		case printJSON:
+			// Results are relative to the repo searched, so each
+			// repo gets its own ripgrep run.
+			if len(paths) == 0 {
+				return runrgJSON(args, "", newFormatter(), w, errw)
+			}
+			code := 1
+			for _, path := range paths {
+				code = combineExitStatus(code, runrgJSON(args, path, newFormatter(), w, errw))
+			}
+			return code
+		default:
+			return printLines(w, b, runs, opts, paths)
+		}
+	}
+
+	if len(paths) <= 1 {
+		return search(paths, os.Stdout, os.Stderr)
+	}
+	if _, ok := wholeRunFlag(passthrough); ok && choosePrinter(newBackend(paths, nil), runs, args) == printRg {
+		// Flags like --sort and --stats need one ripgrep run to see
+		// every path.
+		return search(paths, os.Stdout, os.Stderr)
+	}
+	batches := batchRepos(paths, searchWorkers(), func(path string) bool {
+		return choosePrinter(newBackend([]string{path}, nil), runs, args) == printRg
+	})
+	sep := tty && outputFormat == "human" && !nativeEngine && len(runs) == 1 && !runs[0].filtered()
+	return searchRepos(os.Stdout, os.Stderr, batches, sep, search)
+}
+
+// printer is how the results of searching a path are printed.
+type printer int
+
+const (
+	// printRg lets ripgrep print its results.
+	printRg printer = iota
+	// printJSON runs ripgrep with --json and writes the results with the
+	// formatter selected by --format.
+	printJSON
+	// printParsed writes the lines printLines gets from a backend.
+	printParsed
+)
+
+// choosePrinter returns how to print the results of runs searched with b.
+// args are the ripgrep flags of the only run, if there is one.
+func choosePrinter(b backend, runs []*rgRun, args []string) printer {
+	if _, ok := b.(*rgBackend); !ok || len(runs) != 1 || runs[0].filtered() {
+		return printParsed
+	}
+	switch {
+	case outputFormat == "human":
+		// ripgrep prints results for people best, respecting its
+		// flags and config file.
+		return printRg
+	case listsFiles(args):
+		// rg --json does not list files.
+		return printParsed
+	default:
+		return printJSON
+	}
+}
+
+// printLines runs the ripgrep invocations runs over paths with b, writing
+// the lines found to w. If paths is a single repo, results are formatted
+// relative to it.
+func printLines(w io.Writer, b backend, runs []*rgRun, opts searchOptions, paths []string) int {
+	// We need to post-process the output or search in process, so we
+	// lose ripgrep's terminal formatting. Multiple runs can find the same
+	// lines, so we deduplicate.
+	var (
+		f    formatter
+		repo string
+	)
+	if outputFormat != "human" {
+		f = newFormatter()
+		if len(paths) == 1 {
+			repo = paths[0]
+		}
+	}
+	seen := map[string]bool{}
+	code := 1
+	for _, run := range runs {
+		lines, c := run.output(b, paths, opts)
+		code = combineExitStatus(code, c)
+		for _, l := range lines {
+			s := l.String()
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			if f == nil {
+				fmt.Fprintln(w, s)
+			} else if r, ok := l.result(repo); ok {
+				f.format(w, r)
+			}
+		}
+	}
+	return code
+}
+
 func srcpaths() []string {
 	paths := filepath.SplitList(os.Getenv("SRCPATH"))
 	if len(paths) == 0 {
@@ -172,48 +1191,39 @@ func srcpaths() []string {
 	return paths
 }
 
+// cacheDir returns the directory rgp uses for caches. It respects
+// XDG_CACHE_HOME.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rgp"), nil
+}
+
 type repoPath struct {
 	Path string
 	Repo string
-	Err  error
-}
 
-func walkSRCPath() <-chan repoPath {
-	c := make(chan repoPath, 8)
-	go func() {
-		defer close(c)
-		for _, srcpath := range srcpaths() {
-			err := fastwalk.Walk(srcpath, func(path string, typ os.FileMode) error {
-				if typ != os.ModeDir {
-					return nil
-				}
+	// Name is the canonical name of the repo, eg github.com/acme/api,
+	// derived from its origin remote. It is empty if the repo has no
+	// remote.
+	Name string `json:",omitempty"`
 
-				if base := filepath.Base(path); len(base) > 0 && base[0] == '.' {
-					return filepath.SkipDir
-				}
+	// VCS is the version control system of the repo, eg git or hg.
+	VCS string
 
-				if _, err := os.Stat(filepath.Join(path, ".git")); os.IsNotExist(err) {
-					return nil
-				}
+	// Bare is true for git repos without a working tree. They are
+	// searched at HEAD.
+	Bare bool `json:",omitempty"`
 
-				repo, err := filepath.Rel(srcpath, path)
-				if err != nil {
-					return err
-				}
+	// Parent is the Repo of the repo containing this one. Children are
+	// the paths, relative to Path, of the repos directly inside this
+	// one. They are only set if RGP_NESTED is.
+	Parent   string   `json:",omitempty"`
+	Children []string `json:",omitempty"`
 
-				c <- repoPath{
-					Repo: repo,
-					Path: path,
-				}
-				return filepath.SkipDir
-			})
-			if err != nil {
-				c <- repoPath{Err: err}
-				return
-			}
-		}
-	}()
-	return c
+	Err error `json:"-"`
 }
 
 func executor(s string) {
@@ -222,7 +1232,13 @@ func executor(s string) {
 		return
 	}
 
-	cmd := exec.Command(os.Args[0], strings.Fields(s)...)
+	args := strings.Fields(s)
+	if args[0] == ":explain" {
+		// meta-command to explain a query instead of running it
+		args[0] = "--explain"
+	}
+
+	cmd := exec.Command(os.Args[0], args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -232,14 +1248,31 @@ func executor(s string) {
 	return
 }
 
+// completionWait is how long the completer waits for the first walk of
+// SRCPATH before suggesting repos.
+const completionWait = 200 * time.Millisecond
+
 func completer(d prompt.Document) []prompt.Suggest {
 	word := strings.TrimSpace(d.GetWordBeforeCursor())
+	if strings.HasPrefix(word, ":") && d.TextBeforeCursor() == word {
+		s := []prompt.Suggest{
+			{Text: ":explain", Description: "Print the query plan and commands for the rest of the line, without running them."},
+		}
+		return prompt.FilterHasPrefix(s, word, true)
+	}
 	idx := strings.Index(word, ":")
 	if idx < 0 {
 		s := []prompt.Suggest{
+			{Text: "branch:", Description: "Search a git branch, tag or commit instead of the working tree."},
 			{Text: "case:", Description: "Sets case sensitivity yes|no|auto. Defaults to auto."},
 			{Text: "file:", Description: "Limit results to files matching glob."},
-			{Text: "repo:", Description: "Limit results to files matching repo substring."},
+			{Text: "lang:", Description: "Limit results to files of a language (ripgrep file type)."},
+			{Text: "order:", Description: "Sets whether terms must match in order yes|no. Defaults to no."},
+			{Text: "repo:", Description: "Limit results to repos matching substring, glob, regex or =name."},
+			{Text: "repogroup:", Description: "Limit results to the repos in a group from the config file."},
+			{Text: "sym:", Description: "Search for symbol definitions matching substring."},
+			{Text: "scope:", Description: "Sets whether terms match on a line or in a file line|file. Defaults to line."},
+			{Text: "vcs:", Description: "Limit results to repos using a version control system, eg git or hg."},
 		}
 		if word != "" {
 			s = append([]prompt.Suggest{{Text: word, Description: "Search for lines matching " + word}}, s...)
@@ -255,38 +1288,92 @@ func completer(d prompt.Document) []prompt.Suggest {
 			{Text: "case:auto", Description: "(Default) Searches case insensitively if the pattern is all lowercase."},
 		}
 		return prompt.FilterHasPrefix(s, word, true)
+	case "order":
+		s := []prompt.Suggest{
+			{Text: "order:yes", Description: "Terms must match in the order they are written."},
+			{Text: "order:no", Description: "(Default) Terms can match in any order on a line."},
+		}
+		return prompt.FilterHasPrefix(s, word, true)
+	case "scope":
+		s := []prompt.Suggest{
+			{Text: "scope:line", Description: "(Default) Terms must all match on a line. Negated patterns exclude lines."},
+			{Text: "scope:file", Description: "Terms must all match in a file. Negated patterns exclude files."},
+		}
+		return prompt.FilterHasPrefix(s, word, true)
 	case "r", "repo":
 		type scoredRepo struct {
-			Score int
+			Score float64
 			Repo  string
+			Name  string
 		}
-		var repos []scoredRepo
-		for rp := range walkSRCPath() {
-			if rp.Err != nil {
-				log.Println("srcpath walk failed:", rp.Err)
-				continue
+		m, err := compileRepoPattern(query)
+		if err != nil {
+			return []prompt.Suggest{{Text: word, Description: err.Error()}}
+		}
+		var (
+			repos   []scoredRepo
+			matched int
+		)
+		frecency := frecencyScores()
+		ctx, cancel := context.WithTimeout(context.Background(), completionWait)
+		defer cancel()
+		for _, rp := range completionRepos(ctx) {
+			if m.MatchRepo(rp) {
+				matched++
 			}
-			idx := strings.LastIndex(rp.Repo, query)
-			if idx >= 0 {
-				// Prefer matches near the end of the string
-				score := len(rp.Repo) - idx
-				repos = append(repos, scoredRepo{Score: score, Repo: rp.Repo})
+			// Match on the path name or the canonical name, whichever
+			// is better.
+			score, ok := m.Score(rp.Repo)
+			if rp.Name != "" {
+				if s, nameOK := m.Score(rp.Name); nameOK && (!ok || s > score) {
+					score, ok = s, true
+				}
+			}
+			if ok {
+				// Prefer good matches, and repos which are used
+				// often.
+				repos = append(repos, scoredRepo{Score: rankRepoMatch(score, frecency[rp.Path]), Repo: rp.Repo, Name: rp.Name})
 			}
 		}
 		sort.Slice(repos, func(i, j int) bool {
 			if repos[i].Score != repos[j].Score {
-				return repos[i].Score < repos[j].Score
+				return repos[i].Score > repos[j].Score
+			}
+			if len(repos[i].Repo) != len(repos[j].Repo) {
+				return len(repos[i].Repo) < len(repos[j].Repo)
 			}
 			return repos[i].Repo < repos[j].Repo
 		})
 		var s []prompt.Suggest
-		if len(repos) > 1 {
-			s = append(s, prompt.Suggest{Text: word, Description: fmt.Sprintf("Limit results %d repos", len(repos))})
+		if matched > 1 {
+			s = append(s, prompt.Suggest{Text: word, Description: fmt.Sprintf("Limit results %d repos", matched)})
 		}
 		for _, r := range repos {
-			s = append(s, prompt.Suggest{Text: typ + ":" + r.Repo})
+			desc := r.Name
+			if desc == r.Repo {
+				desc = ""
+			}
+			s = append(s, prompt.Suggest{Text: typ + ":" + r.Repo, Description: desc})
 		}
 		return s
+	case "repogroup":
+		var s []prompt.Suggest
+		for _, name := range repoGroupNames() {
+			s = append(s, prompt.Suggest{Text: "repogroup:" + name})
+		}
+		return prompt.FilterHasPrefix(s, word, true)
+	case "vcs":
+		var s []prompt.Suggest
+		for _, vcs := range vcsNames() {
+			s = append(s, prompt.Suggest{Text: "vcs:" + vcs})
+		}
+		return prompt.FilterHasPrefix(s, word, true)
+	case "lang":
+		var s []prompt.Suggest
+		for _, lang := range languages() {
+			s = append(s, prompt.Suggest{Text: "lang:" + lang})
+		}
+		return prompt.FilterHasPrefix(s, word, true)
 	case "f", "file":
 		return []prompt.Suggest{{Text: word, Description: "Limit results to files matching glob " + query}}
 
@@ -299,25 +1386,54 @@ func main() {
 		fmt.Printf("SRCPATH=%s\n", strings.Join(srcpaths(), string(os.PathListSeparator)))
 		fmt.Println("Please use `Ctrl-D` to exit this program.")
 		defer fmt.Println("Bye!")
+		// Start loading the repos for completion, so they are likely
+		// ready by the first keystroke.
+		ctx, cancel := context.WithCancel(context.Background())
+		startCompletionRepos(ctx)
 		p := prompt.New(
 			executor,
 			completer,
 		)
 		p.Run()
+		cancel()
 		return
 	}
 
 	var (
 		passthrough []string
 		q           query.Q
+		opts        searchOptions
 	)
 	{
 		args := os.Args[1:]
+		if len(args) > 0 {
+			switch args[0] {
+			case "repos":
+				os.Exit(reposCommand(args[1:]))
+			case "frecency":
+				os.Exit(frecencyCommand(args[1:]))
+			case "index":
+				os.Exit(indexCommand(args[1:]))
+			}
+		}
+		for len(args) > 0 {
+			if args[0] == "--explain" {
+				explain = true
+			} else if strings.HasPrefix(args[0], "--engine=") {
+				if err := parseEngine(strings.TrimPrefix(args[0], "--engine=")); err != nil {
+					log.Fatal(err)
+				}
+			} else if strings.HasPrefix(args[0], "--format=") {
+				if err := parseFormat(strings.TrimPrefix(args[0], "--format=")); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				break
+			}
+			args = args[1:]
+		}
 		if len(args) == 0 || (len(args) == 1 && (args[0] == "--help" || args[0] == "-h")) {
-			code := runrg(args)
-			fmt.Println()
-			fmt.Printf("USAGE: %s [ripgrep flags...] PATTERN\n", os.Args[0])
-			os.Exit(code)
+			os.Exit(usage(args))
 		}
 
 		dashDash := false
@@ -333,63 +1449,88 @@ func main() {
 		if !dashDash {
 			rawQ = strings.Join(args, " ")
 		}
+		if nativeEngine && len(passthrough) > 0 {
+			log.Println("ignoring ripgrep flags with --engine=native")
+			passthrough = nil
+		}
+		if strings.TrimSpace(rawQ) == "" {
+			os.Exit(usage(nil))
+		}
 
 		// TODO maybe a mode which takes a regex emacs ivy builds and
 		// splitting it back into a pattern.
 
-		var err error
-		q, err = query.Parse(rawQ)
+		parsed, o, err := parseQueryTree(rawQ)
 		if err != nil {
 			log.Fatal(err)
 		}
-		q = query.Simplify(q)
+		q, opts = query.Simplify(parsed), o
+		if explain {
+			explainf("parsed: %s", parsed)
+			explainf("query: %s", q)
+		}
 	}
 
 	// if we don't have a repo query, root the search from cwd
 	if !hasRepoQuery(q) {
-		args, err := ripgrep(q)
-		if err != nil {
-			log.Fatal(err)
-		}
-		code := runrg(append(passthrough, args...))
-		os.Exit(code)
+		os.Exit(search(passthrough, q, opts, nil))
 	}
 
-	var noRepoQ query.Q
-	var paths []string
-	for rp := range walkSRCPath() {
-		if rp.Err != nil {
-			log.Fatal(rp.Err)
-		}
-		q2 := simplifyRepoQuery(q, rp.Repo)
-		if c, ok := q2.(*query.Const); ok && !c.Value {
-			continue
-		}
-		noRepoQ = q2
-		paths = append(paths, rp.Path)
+	plans, err := planRepos(q, walkSRCPath(context.Background()))
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	// Update q to be the pattern without the repo atoms.
-	if noRepoQ == nil {
-		// we didn't match anything
-		os.Exit(1)
+	var used []repoPath
+	for _, p := range plans {
+		used = append(used, p.Repos...)
 	}
-	q = noRepoQ
+	recordRepoUse(used)
 
-	if _, ok := q.(*query.Const); ok {
-		// If we simplify down to a constant, we are a repo query only.
-		for _, path := range paths {
-			fmt.Println(path)
+	code := 1
+	for _, p := range plans {
+		if explain {
+			explainf("plan: %s", p.Query)
+			for _, rp := range p.Repos {
+				explainf("  repo %s %s", rp.Repo, rp.Path)
+			}
 		}
-		return
+		if _, ok := p.Query.(*query.Const); ok {
+			// If we simplify down to a constant, we are a repo query only.
+			for _, rp := range p.Repos {
+				fmt.Println(rp.Path)
+			}
+			code = combineExitStatus(code, 0)
+			continue
+		}
+		code = combineExitStatus(code, search(passthrough, p.Query, opts, p.Repos))
 	}
+	os.Exit(code)
+}
 
-	args, err := ripgrep(q)
-	if err != nil {
-		log.Fatal(err)
+// usage prints how to use rgp, after ripgrep's usage for args. It returns
+// the exit code.
+func usage(args []string) int {
+	code := 0
+	if !nativeEngine && !explain {
+		// ripgrep prints its usage before ours.
+		code = runrg(args, nil, os.Stdout, os.Stderr)
+		fmt.Println()
 	}
-	args = append(passthrough, args...)
-	args = append(args, paths...)
-	code := runrg(args)
-	os.Exit(code)
+	fmt.Printf("USAGE: %s [--explain] [--engine=rg|native] [--format=human|json|vimgrep] [ripgrep flags... --] PATTERN\n", os.Args[0])
+	fmt.Println()
+	fmt.Println("--explain prints the query plan and the commands rgp would run, without running them.")
+	fmt.Println("--engine=native searches in process instead of running ripgrep, which does not need")
+	fmt.Println("rg installed. It does not support ripgrep flags.")
+	fmt.Println("--format prints results for people (the default), as JSON lines, or like rg --vimgrep.")
+	fmt.Println()
+	fmt.Printf("       %s repos [--json] [repo:PATTERN ...]\n", os.Args[0])
+	fmt.Println()
+	fmt.Printf("       %s frecency [--json] [--reset]\n", os.Args[0])
+	fmt.Println()
+	fmt.Printf("       %s index [--clear] [repo:PATTERN ...]\n", os.Args[0])
+	fmt.Println()
+	fmt.Println("repos lists the repos in SRCPATH. frecency prints the stats which rank repo")
+	fmt.Println("completion. index builds the trigram indexes which speed up searching repos.")
+	fmt.Println("Use -- repos to search for \"repos\".")
+	return code
 }
@@ -1,42 +1,338 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
-
-	"github.com/google/zoekt/query"
 )
 
+func init() {
+	// Do not depend on the installed version of ripgrep.
+	rgTypeList = func() (map[string][]string, error) {
+		return parseTypeList("go: *.go\njs: *.js, *.jsx\npy: *.py, *.pyi\nts: *.ts, *.tsx\n"), nil
+	}
+}
+
 func TestRipGrep(t *testing.T) {
+	cases := []struct {
+		Query   string
+		Args    []string
+		Exclude [][]string
+	}{
+		{"foo", []string{"-i", "-e", "foo"}, nil},
+		{"foo bar", []string{"-i", "-e", "foo.*?bar", "-e", "bar.*?foo"}, nil},
+		{"foo bar order:yes", []string{"-i", "-e", "foo.*?bar"}, nil},
+		{"foo bar case:yes", []string{"-e", "foo.*?bar", "-e", "bar.*?foo"}, nil},
+		{"foo Bar", []string{"-e", "(?i:foo).*?Bar", "-e", "Bar.*?(?i:foo)"}, nil},
+		{"foo bar baz", []string{"-i", "-e", "foo.*?bar.*?baz", "-e", "foo.*?baz.*?bar", "-e", "bar.*?foo.*?baz", "-e", "bar.*?baz.*?foo", "-e", "baz.*?foo.*?bar", "-e", "baz.*?bar.*?foo"}, nil},
+		{"foo.*bar", []string{"-i", "-e", "foo.*bar"}, nil},
+		{"foo f:bar", []string{"--iglob", "*bar*", "-i", "-e", "foo"}, nil},
+		{"foo f:bar case:yes", []string{"-g", "*bar*", "-e", "foo"}, nil},
+		{"f:bar", []string{"--iglob", "*bar*", "--files"}, nil},
+		{"f:bar f:baz", []string{"--iglob", "*bar*", "--iglob", "*baz*", "--files"}, nil},
+		{"f:bar -f:baz", []string{"--iglob", "*bar*", "--iglob", "!*baz*", "--files"}, nil},
+		{"foo f:bar*.go case:yes", []string{"-g", "bar*.go", "-e", "foo"}, nil},
+		{"foo f:bar*", []string{"--iglob", "bar*", "-i", "-e", "foo"}, nil},
+		{"foo or bar", []string{"-i", "-e", "foo", "-e", "bar"}, nil},
+		{"foo or Bar", []string{"-e", "(?i:foo)", "-e", "Bar"}, nil},
+		{"(foo or bar) baz", []string{"-i", "-e", "(?:foo|bar).*?baz", "-e", "baz.*?(?:foo|bar)"}, nil},
+		{"(foo or bar) baz order:yes", []string{"-i", "-e", "(?:foo|bar).*?baz"}, nil},
+		{"(Writer or Reader) f:*.go", []string{"--iglob", "*.go", "-e", "Writer", "-e", "Reader"}, nil},
+		{"(foo bar) or baz", []string{"-i", "-e", "foo.*?bar|bar.*?foo", "-e", "baz"}, nil},
+		{"-foo", []string{"-v", "-i", "-e", "foo"}, nil},
+		{"-foo scope:file", []string{"--files-without-match", "-i", "-e", "foo"}, nil},
+		{"f:*.go -foo -bar", []string{"--iglob", "*.go", "-v", "-i", "-e", "foo", "-e", "bar"}, nil},
+		{"TODO -FIXME", []string{"-e", "TODO"}, [][]string{{"FIXME"}}},
+		{"TODO -FIXME scope:file", []string{"-e", "TODO"}, [][]string{{"FIXME"}}},
+		{"todo -fixme", []string{"-i", "-e", "todo"}, [][]string{{"(?i)fixme"}}},
+		{"todo -fixme -(foo bar)", []string{"-i", "-e", "todo"}, [][]string{{"(?i)fixme"}, {"(?i)foo.*?bar|bar.*?foo"}}},
+		{"(foo bar baz qux) or x", []string{"-i", "-e", "foo|bar|baz|qux", "-e", "x"}, nil},
+		{"x -(foo bar baz qux)", []string{"-i", "-e", "x"}, [][]string{{"(?i)foo", "(?i)bar", "(?i)baz", "(?i)qux"}}},
+		{"-(foo bar baz qux)", []string{"-e", ""}, [][]string{{"(?i)foo", "(?i)bar", "(?i)baz", "(?i)qux"}}},
+		{"-(foo bar baz qux) -x", []string{"-v", "-i", "-e", "x"}, [][]string{{"(?i)foo", "(?i)bar", "(?i)baz", "(?i)qux"}}},
+		{"-(foo bar baz qux) scope:file", []string{"--files"}, [][]string{{"(?i)foo", "(?i)bar", "(?i)baz", "(?i)qux"}}},
+		{"zz -(foo bar) scope:file", []string{"-i", "-e", "zz"}, [][]string{{"(?i)foo", "(?i)bar"}}},
+		{"zz -(foo bar baz qux) scope:file", []string{"-i", "-e", "zz"}, [][]string{{"(?i)foo", "(?i)bar", "(?i)baz", "(?i)qux"}}},
+		{"-(foo bar) scope:file", []string{"--files"}, [][]string{{"(?i)foo", "(?i)bar"}}},
+		{"-(foo bar) -x scope:file", []string{"--files-without-match", "-i", "-e", "x"}, [][]string{{"(?i)foo", "(?i)bar"}}},
+		{"scope:nope", nil, nil},
+		{"order:nope", nil, nil},
+		{"lang:go", []string{"--type", "go", "--files"}, nil},
+		{"foo lang:Python", []string{"--type", "py", "-i", "-e", "foo"}, nil},
+		{"foo -lang:js", []string{"-T", "js", "-i", "-e", "foo"}, nil},
+		{"foo lang:go lang:golang", []string{"--type", "go", "-i", "-e", "foo"}, nil},
+		{"foo lang:go -lang:ts", []string{"--type", "go", "-T", "ts", "-i", "-e", "foo"}, nil},
+		{"foo lang:go lang:ts", nil, nil},
+		{"lang:cobol", nil, nil},
+	}
+	for _, tt := range cases {
+		q, opts, err := parseQuery(tt.Query)
+		if err != nil {
+			if tt.Args != nil {
+				t.Fatal(tt.Query, err)
+			}
+			continue
+		}
+		got, err := ripgrep(q, opts)
+		if err != nil {
+			if tt.Args != nil {
+				t.Errorf("%s got error %v", q, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got.Args, tt.Args) {
+			t.Errorf("%s == %v != %v", q, got.Args, tt.Args)
+		}
+		if !reflect.DeepEqual(got.Exclude, tt.Exclude) {
+			t.Errorf("%s excludes %v != %v", q, got.Exclude, tt.Exclude)
+		}
+	}
+}
+
+func TestRipGrepInclude(t *testing.T) {
+	cases := []struct {
+		Query   string
+		Args    []string
+		Include []string
+	}{
+		{"foo bar", []string{"-i", "-e", "foo.*?bar", "-e", "bar.*?foo"}, nil},
+		{"a b c d", []string{"-i", "-e", "a", "-e", "b", "-e", "c", "-e", "d"}, []string{"(?i)a", "(?i)b", "(?i)c", "(?i)d"}},
+		{"a b c D", []string{"-e", "(?i:a)", "-e", "(?i:b)", "-e", "(?i:c)", "-e", "D"}, []string{"(?i:a)", "(?i:b)", "(?i:c)", "D"}},
+		{"a b c d order:yes", []string{"-i", "-e", "a.*?b.*?c.*?d"}, nil},
+		{"(foo bar baz qux) or x", []string{"-i", "-e", "foo|bar|baz|qux", "-e", "x"}, []string{"(?i)foo|x", "(?i)bar|x", "(?i)baz|x", "(?i)qux|x"}},
+		{"(foo bar baz qux) or (x y)", []string{"-i", "-e", "foo|bar|baz|qux", "-e", "x.*?y|y.*?x"}, []string{"(?i)foo|x.*?y|y.*?x", "(?i)bar|x.*?y|y.*?x", "(?i)baz|x.*?y|y.*?x", "(?i)qux|x.*?y|y.*?x"}},
+	}
+	for _, tt := range cases {
+		q, opts, err := parseQuery(tt.Query)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		got, err := ripgrep(q, opts)
+		if err != nil {
+			t.Fatalf("%s got error %v", q, err)
+		}
+		if !reflect.DeepEqual(got.Args, tt.Args) {
+			t.Errorf("%s == %v != %v", q, got.Args, tt.Args)
+		}
+		if !reflect.DeepEqual(got.Include, tt.Include) {
+			t.Errorf("%s includes %v != %v", q, got.Include, tt.Include)
+		}
+	}
+}
+
+func TestRipGrepFileScope(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Args     []string
+		FileArgs [][]string
+	}{
+		{"foo scope:file", []string{"-i", "-e", "foo"}, nil},
+		{"context.Context sql.DB scope:file", []string{"-e", "context.Context", "-e", "sql.DB"}, [][]string{
+			{"--files-with-matches", "-e", "context.Context"},
+			{"--files-with-matches", "-e", "sql.DB"},
+		}},
+		{"(foo or bar) baz f:*.go scope:file", []string{"--iglob", "*.go", "-i", "-e", "foo|bar", "-e", "baz"}, [][]string{
+			{"--iglob", "*.go", "--files-with-matches", "-i", "-e", "foo|bar"},
+			{"--iglob", "*.go", "--files-with-matches", "-i", "-e", "baz"},
+		}},
+	}
+	for _, tt := range cases {
+		q, opts, err := parseQuery(tt.Query)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		got, err := ripgrep(q, opts)
+		if err != nil {
+			t.Fatalf("%s got error %v", q, err)
+		}
+		if !reflect.DeepEqual(got.Args, tt.Args) {
+			t.Errorf("%s == %v != %v", q, got.Args, tt.Args)
+		}
+		if !reflect.DeepEqual(got.FileArgs, tt.FileArgs) {
+			t.Errorf("%s file args %v != %v", q, got.FileArgs, tt.FileArgs)
+		}
+	}
+}
+
+func TestRipGrepRuns(t *testing.T) {
 	cases := []struct {
 		Query string
-		Args  []string
+		Runs  [][]string
 	}{
-		{"foo", []string{"-i", "-e", "foo"}},
-		{"foo bar", []string{"-i", "-e", "foo.*?bar"}},
-		{"foo bar case:yes", []string{"-e", "foo.*?bar"}},
-		{"foo Bar", []string{"-e", "(?i:foo).*?Bar"}},
-		{"foo.*bar", []string{"-i", "-e", "foo.*bar"}},
-		{"foo f:bar", []string{"--iglob", "*bar*", "-i", "-e", "foo"}},
-		{"foo f:bar case:yes", []string{"-g", "*bar*", "-e", "foo"}},
-		{"f:bar", []string{"--iglob", "*bar*", "--files"}},
-		{"f:bar f:baz", []string{"--iglob", "*bar*", "--iglob", "*baz*", "--files"}},
-		{"f:bar -f:baz", []string{"--iglob", "*bar*", "--iglob", "!*baz*", "--files"}},
-		{"foo f:bar*.go case:yes", []string{"-g", "bar*.go", "-e", "foo"}},
-		{"foo f:bar*", []string{"--iglob", "bar*", "-i", "-e", "foo"}},
+		{"foo or bar", [][]string{{"-i", "-e", "foo", "-e", "bar"}}},
+		{"(foo -bar f:*.go) or baz", [][]string{
+			{"-i", "-e", "baz"},
+			{"--iglob", "*.go", "-i", "-e", "foo"},
+		}},
+		{"foo or f:bar", [][]string{
+			{"-i", "-e", "foo"},
+			{"--iglob", "*bar*", "--files"},
+		}},
+		{"(foo f:*.go) or (bar f:*.ts)", [][]string{
+			{"--iglob", "*.go", "-i", "-e", "foo"},
+			{"--iglob", "*.ts", "-i", "-e", "bar"},
+		}},
+		{"foo (f:*.go or f:*.ts)", [][]string{
+			{"--iglob", "*.go", "-i", "-e", "foo"},
+			{"--iglob", "*.ts", "-i", "-e", "foo"},
+		}},
+		{"foo (lang:go or lang:ts)", [][]string{
+			{"--type", "go", "-i", "-e", "foo"},
+			{"--type", "ts", "-i", "-e", "foo"},
+		}},
+		{"foo -(f:*.go or f:*.ts)", [][]string{
+			{"--iglob", "!*.go", "--iglob", "!*.ts", "-i", "-e", "foo"},
+		}},
 	}
 	for _, tt := range cases {
-		q, err := query.Parse(tt.Query)
+		q, opts, err := parseQuery(tt.Query)
 		if err != nil {
 			t.Fatal(tt.Query, err)
 		}
-		q = query.Simplify(q)
-		got, err := ripgrep(q)
-		if err != nil && tt.Args != nil {
+		runs, err := ripgrepRuns(q, opts)
+		if err != nil {
 			t.Errorf("%s got error %v", q, err)
 		}
-		if !reflect.DeepEqual(got, tt.Args) {
-			t.Errorf("%s == %v != %v", q, got, tt.Args)
+		var got [][]string
+		for _, run := range runs {
+			got = append(got, run.Args)
+		}
+		if !reflect.DeepEqual(got, tt.Runs) {
+			t.Errorf("%s == %v != %v", q, got, tt.Runs)
+		}
+	}
+}
+
+func TestPlanRepos(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	for _, repo := range []string{"github.com/acme/api/.git", "github.com/acme/web/.git", "github.com/acme/tools/.git", "hg.example.com/lib/.hg", "mirrors/thing/.git"} {
+		if err := os.MkdirAll(filepath.Join(srcpath, repo), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := "[remote \"origin\"]\n\turl = git@github.com:other/thing.git\n"
+	if err := ioutil.WriteFile(filepath.Join(srcpath, "mirrors/thing/.git/config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("SRCPATH", os.Getenv("SRCPATH"))
+	os.Setenv("SRCPATH", srcpath)
+	cache, err := ioutil.TempDir("", "rgp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	cases := []struct {
+		Query string
+		Want  map[string][]string
+	}{
+		{"(repo:api f:*.proto) or (repo:web f:*.ts)", map[string][]string{
+			`glob:"*.proto"`: {"github.com/acme/api"},
+			`glob:"*.ts"`:    {"github.com/acme/web"},
+		}},
+		{"foo repo:acme -repo:tools", map[string][]string{
+			`substr:"foo"`: {"github.com/acme/api", "github.com/acme/web"},
+		}},
+		{"repo:api or (repo:web foo)", map[string][]string{
+			"TRUE":         {"github.com/acme/api"},
+			`substr:"foo"`: {"github.com/acme/web"},
+		}},
+		{"repo:nothing foo", map[string][]string{}},
+		{"repo:other/thing", map[string][]string{
+			"TRUE": {"mirrors/thing"},
+		}},
+		{"vcs:hg", map[string][]string{
+			"TRUE": {"hg.example.com/lib"},
+		}},
+		{"foo -vcs:git", map[string][]string{
+			`substr:"foo"`: {"hg.example.com/lib"},
+		}},
+	}
+	for _, tt := range cases {
+		q, _, err := parseQuery(tt.Query)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		plans, err := planRepos(q, walkSRCPath(context.Background()))
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		got := map[string][]string{}
+		for _, p := range plans {
+			var repos []string
+			for _, rp := range p.Repos {
+				repos = append(repos, rp.Repo)
+			}
+			sort.Strings(repos)
+			got[p.Query.String()] = repos
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s planned %v != %v", tt.Query, got, tt.Want)
+		}
+	}
+}
+
+func TestExcludeGlob(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"vendor/lib":                           "!/vendor/lib",
+		"./vendor/lib":                         "!/vendor/lib",
+		filepath.Join(cwd, "vendor", "lib[1]"): `!/vendor/lib\[1\]`,
+		"/nonexistent/src/app/vendor/lib":      "!**/nonexistent/src/app/vendor/lib",
+	}
+	for path, want := range cases {
+		if got := excludeGlob(path); got != want {
+			t.Errorf("excludeGlob(%q) == %q != %q", path, got, want)
+		}
+	}
+}
+
+func TestChoosePrinter(t *testing.T) {
+	defer func(format string) { outputFormat = format }(outputFormat)
+
+	rg := &rgBackend{}
+	plain := []*rgRun{{Args: []string{"-e", "foo"}}}
+	files := []*rgRun{{Args: []string{"--files"}}}
+	filtered := []*rgRun{{Args: []string{"-e", "TODO"}, Exclude: [][]string{{"FIXME"}}}}
+	split := []*rgRun{{Args: []string{"-e", "foo"}}, {Args: []string{"--files"}}}
+	cases := []struct {
+		Format string
+		B      backend
+		Runs   []*rgRun
+		Want   printer
+	}{
+		{"human", rg, plain, printRg},
+		{"human", rg, files, printRg},
+		{"human", rg, filtered, printParsed},
+		{"human", rg, split, printParsed},
+		{"human", &nativeBackend{}, plain, printParsed},
+		{"json", rg, plain, printJSON},
+		{"vimgrep", rg, plain, printJSON},
+		{"json", rg, files, printParsed},
+		{"json", rg, filtered, printParsed},
+		{"json", &nativeBackend{}, plain, printParsed},
+	}
+	for _, tt := range cases {
+		outputFormat = tt.Format
+		var args []string
+		if len(tt.Runs) == 1 {
+			args = tt.Runs[0].Args
+		}
+		if got := choosePrinter(tt.B, tt.Runs, args); got != tt.Want {
+			t.Errorf("choosePrinter(%T, %v) with --format=%s == %d != %d", tt.B, args, tt.Format, got, tt.Want)
 		}
 	}
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/keegancsmith/rgp/internal/fastwalk"
+)
+
+// nativeEngine is set by --engine=native. rgp then searches in process with
+// nativeBackend, so it works without ripgrep installed.
+var nativeEngine bool
+
+// parseEngine sets the search engine from the value of --engine.
+func parseEngine(name string) error {
+	switch name {
+	case "rg":
+		nativeEngine = false
+	case "native":
+		nativeEngine = true
+	default:
+		return fmt.Errorf("unknown engine %q, want rg or native", name)
+	}
+	return nil
+}
+
+// nativeBackend searches files in process. It understands the flags
+// ripgrep() generates, and respects ignore files, hidden files and binary
+// files the way ripgrep does. Its output is what ripgrep prints with
+// filterArgs, in path order.
+type nativeBackend struct {
+	// excludes are globs which exclude nested repos, like
+	// rgBackend.excludes.
+	excludes []string
+
+	// stderr is where errors are written, os.Stderr if nil.
+	stderr io.Writer
+}
+
+func (b *nativeBackend) errw() io.Writer {
+	if b.stderr == nil {
+		return os.Stderr
+	}
+	return b.stderr
+}
+
+func (b *nativeBackend) lines(args, paths []string) ([]rgLine, int) {
+	a := b.parseArgs(args)
+	if explain {
+		explainf("search %s in process with %s", explainPaths(paths), shellQuote(concat(args, b.excludes)))
+		return nil, 0
+	}
+	return nativeSearch(a, paths, b.errw())
+}
+
+func (b *nativeBackend) files(args, paths []string) ([]string, int) {
+	a := b.parseArgs(args)
+	if explain {
+		explainf("list the files in %s in process with %s", explainPaths(paths), shellQuote(concat(args, b.excludes)))
+		return []string{explainFiles}, 0
+	}
+	lines, code := nativeSearch(a, paths, b.errw())
+	files := make([]string, len(lines))
+	for i, l := range lines {
+		files[i] = l.Path
+	}
+	return files, code
+}
+
+func (b *nativeBackend) parseArgs(args []string) *rgArgs {
+	a, err := parseRgArgs(concat(args, b.excludes))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+func explainPaths(paths []string) string {
+	if len(paths) == 0 {
+		return "."
+	}
+	return shellQuote(paths)
+}
+
+// nativeSearch runs the search described by a over paths. If paths is empty
+// the working directory is searched. In a file listing mode each line only
+// has a Path. Errors are written to errw.
+func nativeSearch(a *rgArgs, paths []string, errw io.Writer) ([]rgLine, int) {
+	m, err := newNativeMatcher(a)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	roots := paths
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	var (
+		files  []string
+		failed bool
+	)
+	ignore := newIgnoreTree()
+	for _, root := range roots {
+		found, err := m.walk(ignore, root, len(paths) == 0)
+		if err != nil {
+			fmt.Fprintf(errw, "rgp: %v\n", err)
+			failed = true
+		}
+		files = append(files, found...)
+	}
+
+	lines, ok := m.searchFiles(files, errw)
+	failed = failed || !ok
+	switch {
+	case failed:
+		return lines, 2
+	case len(lines) == 0:
+		return nil, 1
+	default:
+		return lines, 0
+	}
+}
+
+// searchFiles searches files concurrently, returning the results in order.
+// Errors are written to errw, and ok is false if there were any.
+func (m *nativeMatcher) searchFiles(files []string, errw io.Writer) (lines []rgLine, ok bool) {
+	results := make([][]rgLine, len(files))
+	errs := make([]error, len(files))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i], errs[i] = m.searchFile(files[i])
+			}
+		}()
+	}
+	for i := range files {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	ok = true
+	for i := range files {
+		if errs[i] != nil {
+			fmt.Fprintf(errw, "rgp: %v\n", errs[i])
+			ok = false
+		}
+		lines = append(lines, results[i]...)
+	}
+	return lines, ok
+}
+
+// nativeMatcher decides which files to search and which lines match.
+type nativeMatcher struct {
+	mode   rgMode
+	invert bool
+	// re matches a line. It is nil when only listing files.
+	re *regexp.Regexp
+	// fileRe is re for a whole file, used to skip files without a
+	// match quickly.
+	fileRe *regexp.Regexp
+
+	globs      []nativeGlob
+	whitelists bool
+	types      []nativeType
+	typeLists  bool
+
+	cwd string
+}
+
+type nativeGlob struct {
+	glob    *globMatcher
+	negated bool
+}
+
+type nativeType struct {
+	globs   []*globMatcher
+	negated bool
+}
+
+func newNativeMatcher(a *rgArgs) (*nativeMatcher, error) {
+	m := &nativeMatcher{mode: a.Mode, invert: a.Invert}
+	if a.Mode != modeFiles {
+		var alts []string
+		for _, p := range a.Patterns {
+			alts = append(alts, "(?:"+p+")")
+		}
+		pattern := strings.Join(alts, "|")
+		if a.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		var err error
+		if m.re, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+		if m.fileRe, err = regexp.Compile("(?m)" + pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, g := range a.Globs {
+		// A leading slash anchors the glob to the working directory.
+		pattern := g.Pattern
+		anchored := strings.HasPrefix(pattern, "/")
+		gm, err := compileGlob(strings.TrimPrefix(pattern, "/"), g.CaseSensitive)
+		if err != nil {
+			return nil, err
+		}
+		if anchored {
+			gm.basename = false
+		}
+		m.globs = append(m.globs, nativeGlob{glob: gm, negated: g.Negated})
+		m.whitelists = m.whitelists || !g.Negated
+	}
+	for _, t := range a.Types {
+		nt := nativeType{negated: t.Negated}
+		for _, glob := range t.Globs {
+			gm, err := compileGlob(glob, true)
+			if err != nil {
+				return nil, err
+			}
+			// Types match file names.
+			gm.basename = true
+			nt.globs = append(nt.globs, gm)
+		}
+		m.types = append(m.types, nt)
+		m.typeLists = m.typeLists || !t.Negated
+	}
+
+	var err error
+	m.cwd, err = os.Getwd()
+	return m, err
+}
+
+// walk returns the files to search under root, sorted. If root is a file it
+// is searched regardless of globs and ignore files, like ripgrep does for
+// the paths it is given. If implicit is true, root is the working
+// directory and paths are printed relative to it.
+func (m *nativeMatcher) walk(ignore *ignoreTree, root string, implicit bool) ([]string, error) {
+	files, _, err := m.walkTree(ignore, root, implicit)
+	return files, err
+}
+
+// walkTree is walk, but also returns the directories read to find the
+// files, including root.
+func (m *nativeMatcher) walkTree(ignore *ignoreTree, root string, implicit bool) (files, dirs []string, err error) {
+	root = filepath.Clean(root)
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.IsDir() {
+		return []string{root}, nil, nil
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mu sync.Mutex
+	dirs = []string{root}
+	err = fastwalk.WalkContext(context.Background(), root, nil, func(path string, typ os.FileMode) error {
+		if path == root {
+			return nil
+		}
+		if typ != os.ModeDir && !typ.IsRegular() {
+			// ripgrep does not follow symlinks by default.
+			return nil
+		}
+		isDir := typ == os.ModeDir
+		display := path
+		if implicit {
+			display = strings.TrimPrefix(path, "."+string(filepath.Separator))
+		}
+		if m.skip(ignore, display, filepath.Join(absRoot, path[len(root):]), isDir) {
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mu.Lock()
+		if isDir {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, display)
+		}
+		mu.Unlock()
+		return nil
+	})
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs, err
+}
+
+// skip reports whether a file or directory found while walking should not
+// be searched. display is path as it is printed, and abs is its absolute
+// path. Like ripgrep, globs take precedence over ignore files, which take
+// precedence over types and hidden files. If ignore is nil, ignore files
+// and hidden files have already been excluded.
+func (m *nativeMatcher) skip(ignore *ignoreTree, display, abs string, isDir bool) bool {
+	if skip, ok := m.matchGlobs(abs, isDir); ok {
+		return skip
+	}
+	if ignore != nil && ignore.ignored(abs, isDir) {
+		return true
+	}
+	if !isDir {
+		if skip, ok := m.matchTypes(display); ok {
+			return skip
+		}
+	}
+	return ignore != nil && strings.HasPrefix(filepath.Base(display), ".")
+}
+
+// selects reports whether the file rel, relative to the directory absRoot,
+// should be searched. It is skip for a file from a listing which already
+// excludes ignored and hidden files, such as a trigramIndex.
+func (m *nativeMatcher) selects(absRoot, rel string) bool {
+	if len(m.globs) > 0 {
+		// A directory excluded by a glob excludes everything in it.
+		for i, c := range rel {
+			if c != '/' {
+				continue
+			}
+			if dir := rel[:i]; m.skip(nil, dir, filepath.Join(absRoot, filepath.FromSlash(dir)), true) {
+				return false
+			}
+		}
+	}
+	return !m.skip(nil, rel, filepath.Join(absRoot, filepath.FromSlash(rel)), false)
+}
+
+// matchGlobs returns whether the globs skip abs, and ok if a glob decided.
+// The last matching glob wins.
+func (m *nativeMatcher) matchGlobs(abs string, isDir bool) (skip, ok bool) {
+	if len(m.globs) == 0 {
+		return false, false
+	}
+	// ripgrep matches globs relative to the working directory.
+	p := abs
+	if rel, err := filepath.Rel(m.cwd, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		p = rel
+	}
+	p = filepath.ToSlash(p)
+	for i := len(m.globs) - 1; i >= 0; i-- {
+		if g := m.globs[i]; g.glob.Match(p) {
+			return g.negated, true
+		}
+	}
+	if m.whitelists && !isDir {
+		// Files must match one of the globs.
+		return true, true
+	}
+	return false, false
+}
+
+// matchTypes returns whether the file types skip the file path, and ok if a
+// type decided.
+func (m *nativeMatcher) matchTypes(path string) (skip, ok bool) {
+	for i := len(m.types) - 1; i >= 0; i-- {
+		if m.types[i].match(path) {
+			return m.types[i].negated, true
+		}
+	}
+	if m.typeLists {
+		return true, true
+	}
+	return false, false
+}
+
+func (t nativeType) match(path string) bool {
+	for _, g := range t.globs {
+		if g.Match(filepath.ToSlash(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchFile searches path, returning the matching lines or, when listing
+// files, a line with just the path if it should be listed. Binary files,
+// which contain a NUL byte, have no matching lines.
+func (m *nativeMatcher) searchFile(path string) ([]rgLine, error) {
+	if m.mode == modeFiles {
+		return []rgLine{{Path: path}}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []rgLine
+	if bytes.IndexByte(data, 0) < 0 && (m.invert || m.fileRe.Match(data)) {
+		lines = m.matchLines(path, data)
+	}
+	switch m.mode {
+	case modeFilesWithMatches:
+		if len(lines) > 0 {
+			return []rgLine{{Path: path}}, nil
+		}
+		return nil, nil
+	case modeFilesWithoutMatch:
+		if len(lines) == 0 {
+			return []rgLine{{Path: path}}, nil
+		}
+		return nil, nil
+	}
+	return lines, nil
+}
+
+// matchLines returns the lines of data which match, or with invert which do
+// not.
+func (m *nativeMatcher) matchLines(path string, data []byte) []rgLine {
+	var lines []rgLine
+	for n := 1; len(data) > 0; n++ {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if m.re.Match(line) != m.invert {
+			lines = append(lines, rgLine{
+				Path:    path,
+				Sep:     ':',
+				LineNum: strconv.Itoa(n),
+				Text:    string(line),
+			})
+			if m.mode != modeLines {
+				// One line is enough to list the file.
+				break
+			}
+		}
+	}
+	return lines
+}
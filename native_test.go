@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNativeBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".gitignore":    "*.log\nbuild/\n!keep.log\n",
+		"a.go":          "package a\n\nfunc Foo() {}\n",
+		"b.txt":         "foo\nbar\nFOO baz",
+		"bin.dat":       "Foo\x00",
+		"build/out.go":  "func Foo() {}\n",
+		"debug.log":     "Foo\n",
+		"keep.log":      "Foo\n",
+		".hidden/h.go":  "Foo\n",
+		"sub/.ignore":   "skip.go\n",
+		"sub/skip.go":   "Foo\n",
+		"sub/c.go":      "// Foo\n",
+		"sub/d.{x}.txt": "d\n",
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		Args []string
+		Want []string
+		Code int
+	}{{
+		Args: []string{"-e", "Foo"},
+		Want: []string{"a.go:3:func Foo() {}", "keep.log:1:Foo", "sub/c.go:1:// Foo"},
+	}, {
+		Args: []string{"-i", "-e", "^foo", "-e", "baz$"},
+		Want: []string{"b.txt:1:foo", "b.txt:3:FOO baz", "keep.log:1:Foo"},
+	}, {
+		Args: []string{"-g", "b.txt", "-v", "-e", "foo"},
+		Want: []string{"b.txt:2:bar", "b.txt:3:FOO baz"},
+	}, {
+		Args: []string{"--files"},
+		Want: []string{"a.go", "b.txt", "bin.dat", "keep.log", "sub/c.go", "sub/d.{x}.txt"},
+	}, {
+		// globs override ignore files
+		Args: []string{"-g", "*.log", "--files"},
+		Want: []string{"debug.log", "keep.log"},
+	}, {
+		Args: []string{"-g", "*.{go,txt}", "-g", "!sub", "--files"},
+		Want: []string{"a.go", "b.txt"},
+	}, {
+		Args: []string{"--iglob", "*.GO", "--files-with-matches", "-e", "Foo"},
+		Want: []string{"a.go", "sub/c.go", "sub/skip.go"},
+	}, {
+		Args: []string{"--type-add", "go:*.go", "-T", "go", "--files-without-match", "-e", "Foo"},
+		Want: []string{"b.txt", "bin.dat", "sub/d.{x}.txt"},
+	}, {
+		Args: []string{"-e", "nothing"},
+		Code: 1,
+	}}
+	for _, tt := range cases {
+		b := &nativeBackend{}
+		lines, code := b.lines(tt.Args, []string{dir})
+		var got []string
+		for _, l := range lines {
+			got = append(got, strings.TrimPrefix(l.String(), dir+string(filepath.Separator)))
+		}
+		if code != tt.Code || !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%v: got %q %d want %q %d", tt.Args, got, code, tt.Want, tt.Code)
+		}
+	}
+}
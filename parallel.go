@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultSearchWorkers is how many repos are searched at once, unless the
+// config file sets search.workers. ripgrep already searches the files of a
+// repo in parallel, so this mostly hides the cost of starting it.
+const defaultSearchWorkers = 4
+
+func searchWorkers() int {
+	if c, err := loadConfig(); err == nil && c.Search.Workers > 0 {
+		return c.Search.Workers
+	}
+	return defaultSearchWorkers
+}
+
+// maxRepoBatch is the most repos searched by one ripgrep process.
+const maxRepoBatch = 64
+
+// batchRepos splits paths into batches which are each searched by one
+// ripgrep process, so a SRCPATH of many small repos does not start a process
+// per repo. There are enough batches to keep workers searching, so a few
+// repos are still searched one at a time. batchable reports whether a repo
+// can be searched with others, ie ripgrep prints its results.
+func batchRepos(paths []string, workers int, batchable func(path string) bool) [][]string {
+	size := len(paths) / (workers * 4)
+	if size > maxRepoBatch {
+		size = maxRepoBatch
+	}
+	var (
+		batches [][]string
+		batch   []string
+	)
+	for _, path := range paths {
+		if size <= 1 || !batchable(path) {
+			if len(batch) > 0 {
+				batches = append(batches, batch)
+				batch = nil
+			}
+			batches = append(batches, []string{path})
+			continue
+		}
+		batch = append(batch, path)
+		if len(batch) == size {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// repoSearch searches the repos at paths, writing their results to w and
+// errors to errw. It returns a ripgrep exit code.
+type repoSearch func(paths []string, w, errw io.Writer) int
+
+// searchRepos runs search over each batch of batches, searchWorkers() at a
+// time, writing the output to w and errors to errw. The output of the batch
+// at the head of the queue is written as it is found, while the output of
+// the batches after it is buffered until the batches before them are done.
+// So the output is never interleaved, and is in the order of batches. If sep
+// is true a blank line is written between the output of batches, like
+// ripgrep does between files with --heading.
+//
+// A repo which fails is reported, see searchBatch, but does not stop the
+// search of the others. The exit codes of the batches are combined with
+// combineExitStatus.
+func searchRepos(w, errw io.Writer, batches [][]string, sep bool, search repoSearch) int {
+	if explain {
+		explainf("search %d repos in %d batches, %d at a time", countPaths(batches), len(batches), searchWorkers())
+		code := 1
+		for _, paths := range batches {
+			code = combineExitStatus(code, search(paths, w, errw))
+		}
+		return code
+	}
+
+	out := &orderedWriter{w: w, sep: sep}
+	type result struct {
+		out, err *queuedWriter
+		code     int
+		done     chan struct{}
+	}
+	results := make([]*result, len(batches))
+	for i := range results {
+		results[i] = &result{
+			out:  &queuedWriter{},
+			err:  &queuedWriter{},
+			done: make(chan struct{}),
+		}
+	}
+
+	// A batch holds a slot until it is written, which bounds the output
+	// buffered while waiting on a slow batch.
+	slots := make(chan struct{}, searchWorkers())
+	go func() {
+		for i, paths := range batches {
+			slots <- struct{}{}
+			go func(r *result, paths []string) {
+				r.code = searchBatch(search, paths, r.out, r.err)
+				close(r.done)
+			}(results[i], paths)
+		}
+	}()
+
+	code := 1
+	for i, r := range results {
+		r.out.stream(out)
+		r.err.stream(errw)
+		<-r.done
+		out.next()
+		if r.code == 2 && r.err.n == 0 {
+			// ripgrep explains its own failures, so this only
+			// happens if something else went wrong.
+			fmt.Fprintf(errw, "rgp: %s: search failed\n", strings.Join(batches[i], " "))
+		}
+		code = combineExitStatus(code, r.code)
+		<-slots
+	}
+	return code
+}
+
+// searchBatch runs search over the repos paths. ripgrep has one exit status
+// for all of them, so if it fails the repos are searched again one at a
+// time, to report which failed. Their results were already written, so only
+// the errors of the second search are.
+func searchBatch(search repoSearch, paths []string, w, errw io.Writer) int {
+	if len(paths) == 1 {
+		return search(paths, w, errw)
+	}
+	var errBuf bytes.Buffer
+	code := search(paths, w, &errBuf)
+	if code != 2 {
+		errw.Write(errBuf.Bytes())
+		return code
+	}
+	code = 1
+	for _, path := range paths {
+		cw := &countingWriter{w: errw}
+		c := search([]string{path}, ioutil.Discard, cw)
+		if c == 2 && cw.n == 0 {
+			fmt.Fprintf(errw, "rgp: %s: search failed\n", path)
+		}
+		code = combineExitStatus(code, c)
+	}
+	return code
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return c.w.Write(p)
+}
+
+func countPaths(batches [][]string) int {
+	n := 0
+	for _, paths := range batches {
+		n += len(paths)
+	}
+	return n
+}
+
+// queuedWriter buffers what is written to it until stream is called, then
+// writes to the stream's writer directly.
+type queuedWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+	// n is how many bytes have been written.
+	n int
+}
+
+func (q *queuedWriter) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.n += len(p)
+	if q.w != nil {
+		return q.w.Write(p)
+	}
+	return q.buf.Write(p)
+}
+
+// stream writes what has been buffered to w, and makes later writes go to
+// w.
+func (q *queuedWriter) stream(w io.Writer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.Write(q.buf.Bytes())
+	q.buf = bytes.Buffer{}
+	q.w = w
+}
+
+// orderedWriter writes the output of batches, one after the other. With
+// sep, a blank line separates the output of batches which wrote something.
+type orderedWriter struct {
+	w   io.Writer
+	sep bool
+	// printed is true once a batch has written something, and wrote
+	// once the current batch has.
+	printed, wrote bool
+}
+
+func (o *orderedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !o.wrote {
+		if o.sep && o.printed {
+			o.w.Write([]byte{'\n'})
+		}
+		o.printed, o.wrote = true, true
+	}
+	return o.w.Write(p)
+}
+
+// next starts the output of the next batch.
+func (o *orderedWriter) next() {
+	o.wrote = false
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchRepos(t *testing.T) {
+	var batches [][]string
+	for i := 0; i < 10; i++ {
+		batches = append(batches, []string{fmt.Sprintf("repo%d", i)})
+	}
+	codes := map[string]int{"repo3": 2, "repo5": 1, "repo6": 1, "repo8": 2}
+	search := func(paths []string, w, errw io.Writer) int {
+		path := paths[0]
+		code := codes[path]
+		if code == 1 {
+			return code
+		}
+		// Earlier repos finish last, so the output has to be reordered.
+		n := int(path[len("repo")] - '0')
+		time.Sleep(time.Duration(len(batches)-n) * time.Millisecond)
+		fmt.Fprintf(w, "%s:1:a\n", path)
+		if path == "repo3" {
+			fmt.Fprintf(errw, "rg: %s/x: Permission denied\n", path)
+		}
+		fmt.Fprintf(w, "%s:2:b\n", path)
+		return code
+	}
+
+	var buf, errBuf bytes.Buffer
+	code := searchRepos(&buf, &errBuf, batches, true, search)
+	if code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+	var want []string
+	for _, paths := range batches {
+		if path := paths[0]; codes[path] != 1 {
+			want = append(want, path+":1:a\n"+path+":2:b\n")
+		}
+	}
+	if got := buf.String(); got != strings.Join(want, "\n") {
+		t.Errorf("got output:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+	wantErr := "rg: repo3/x: Permission denied\nrgp: repo8: search failed\n"
+	if got := errBuf.String(); got != wantErr {
+		t.Errorf("got errors:\n%s\nwant:\n%s", got, wantErr)
+	}
+
+	for path := range codes {
+		codes[path] = 1
+	}
+	buf.Reset()
+	if code := searchRepos(&buf, &errBuf, [][]string{{"repo3"}, {"repo5"}}, false, search); code != 1 {
+		t.Errorf("exit code %d with no matches, want 1", code)
+	}
+}
+
+func TestSearchReposBatchFailure(t *testing.T) {
+	codes := map[string]int{"repo0": 0, "repo1": 2, "repo2": 2, "repo3": 1}
+	search := func(paths []string, w, errw io.Writer) int {
+		code := 1
+		for _, path := range paths {
+			if codes[path] == 0 {
+				fmt.Fprintf(w, "%s:1:a\n", path)
+			}
+			if path == "repo2" {
+				fmt.Fprintf(errw, "rg: %s/x: Permission denied\n", path)
+			}
+			code = combineExitStatus(code, codes[path])
+		}
+		return code
+	}
+
+	var buf, errBuf bytes.Buffer
+	code := searchRepos(&buf, &errBuf, [][]string{{"repo0", "repo1", "repo2", "repo3"}}, false, search)
+	if code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+	if got, want := buf.String(), "repo0:1:a\n"; got != want {
+		t.Errorf("got output %q want %q", got, want)
+	}
+	// Errors are reported per repo, rather than for the whole batch.
+	wantErr := "rgp: repo1: search failed\nrg: repo2/x: Permission denied\n"
+	if got := errBuf.String(); got != wantErr {
+		t.Errorf("got errors:\n%s\nwant:\n%s", got, wantErr)
+	}
+}
+
+func TestSearchReposStreams(t *testing.T) {
+	// The first repo's output is written before it finishes.
+	w := &notifyWriter{wrote: make(chan struct{}, 1)}
+	search := func(paths []string, out, errw io.Writer) int {
+		fmt.Fprintf(out, "%s:1:a\n", paths[0])
+		select {
+		case <-w.wrote:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: output was not streamed", paths[0])
+		}
+		return 0
+	}
+	searchRepos(w, &bytes.Buffer{}, [][]string{{"repo0"}}, false, search)
+}
+
+// notifyWriter signals wrote on each write.
+type notifyWriter struct {
+	bytes.Buffer
+	wrote chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	w.wrote <- struct{}{}
+	return n, err
+}
+
+func TestBatchRepos(t *testing.T) {
+	var paths []string
+	for i := 0; i < 20; i++ {
+		paths = append(paths, fmt.Sprintf("repo%d", i))
+	}
+	all := func(string) bool { return true }
+	if got := batchRepos(paths[:4], 4, all); len(got) != 4 {
+		t.Errorf("few repos are searched one at a time, got %q", got)
+	}
+
+	got := batchRepos(paths, 2, func(path string) bool { return path != "repo5" })
+	want := [][]string{
+		{"repo0", "repo1"},
+		{"repo2", "repo3"},
+		{"repo4"},
+		{"repo5"},
+		{"repo6", "repo7"},
+		{"repo8", "repo9"},
+		{"repo10", "repo11"},
+		{"repo12", "repo13"},
+		{"repo14", "repo15"},
+		{"repo16", "repo17"},
+		{"repo18", "repo19"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("batchRepos == %q != %q", got, want)
+	}
+}
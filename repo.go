@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// repoMatcher matches a repo: pattern against repo names. Patterns can be
+//
+//   - =name: the repo must be exactly name.
+//   - ~pattern: the characters of pattern must appear in order in the name,
+//     eg ~kcsrgp matches keegancsmith/rgp.
+//   - a regex, if the pattern uses any of ^$()|+\{: eg ^github.com/acme/api$
+//   - a glob, if the pattern uses any of *?[: eg acme/*-service. The glob
+//     must match whole trailing path components of the name.
+//   - otherwise a substring of the repo name.
+type repoMatcher struct {
+	exact     string
+	substring string
+	fuzzy     string
+	re        *regexp.Regexp
+	glob      *globMatcher
+}
+
+func compileRepoPattern(pattern string) (*repoMatcher, error) {
+	switch {
+	case strings.HasPrefix(pattern, "="):
+		return &repoMatcher{exact: pattern[1:]}, nil
+	case strings.HasPrefix(pattern, "~"):
+		return &repoMatcher{fuzzy: pattern[1:]}, nil
+	case strings.ContainsAny(pattern, `^$()|+\{`):
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repo regex %q: %v", pattern, err)
+		}
+		return &repoMatcher{re: re}, nil
+	case strings.ContainsAny(pattern, "*?["):
+		g, err := compileGlob(pattern, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repo glob %q: %v", pattern, err)
+		}
+		return &repoMatcher{glob: g}, nil
+	default:
+		return &repoMatcher{substring: pattern}, nil
+	}
+}
+
+// Index returns the start of the last match in repo, or -1 if the pattern
+// does not match. Completion uses it to prefer matches near the end of the
+// name.
+func (m *repoMatcher) Index(repo string) int {
+	switch {
+	case m.re != nil:
+		locs := m.re.FindAllStringIndex(repo, -1)
+		if len(locs) == 0 {
+			return -1
+		}
+		return locs[len(locs)-1][0]
+	case m.glob != nil:
+		for i := len(repo) - 1; i >= 0; i-- {
+			if (i == 0 || repo[i-1] == '/') && m.glob.re.MatchString(repo[i:]) {
+				return i
+			}
+		}
+		return -1
+	case m.exact != "":
+		if repo != m.exact {
+			return -1
+		}
+		return 0
+	case m.fuzzy != "":
+		if _, ok := fuzzyMatch(m.fuzzy, repo); !ok {
+			return -1
+		}
+		return 0
+	default:
+		return strings.LastIndex(repo, m.substring)
+	}
+}
+
+// Match reports whether the pattern matches repo.
+func (m *repoMatcher) Match(repo string) bool {
+	return m.Index(repo) >= 0
+}
+
+// Score returns how well the pattern matches repo, higher is better.
+// Completion uses it to order suggestions. Substrings are matched fuzzily,
+// so completing repo:kcsrgp suggests keegancsmith/rgp.
+func (m *repoMatcher) Score(repo string) (int, bool) {
+	if m.re == nil && m.glob == nil && m.exact == "" {
+		p := m.fuzzy
+		if p == "" {
+			p = m.substring
+		}
+		return fuzzyMatch(p, repo)
+	}
+	idx := m.Index(repo)
+	if idx < 0 {
+		return 0, false
+	}
+	// Prefer matches near the end of the name.
+	return -fuzzyScoreMatch * (len(repo) - idx), true
+}
+
+// MatchRepo reports whether the pattern matches either the path name or the
+// canonical name of rp.
+func (m *repoMatcher) MatchRepo(rp repoPath) bool {
+	return m.Match(rp.Repo) || (rp.Name != "" && m.Match(rp.Name))
+}
+
+var repoMatchers struct {
+	sync.Mutex
+	m map[string]*repoMatcher
+}
+
+// cachedRepoMatcher is compileRepoPattern for patterns which are known to
+// be valid, since we evaluate the same patterns against every repo.
+func cachedRepoMatcher(pattern string) *repoMatcher {
+	repoMatchers.Lock()
+	defer repoMatchers.Unlock()
+	if m, ok := repoMatchers.m[pattern]; ok {
+		return m
+	}
+	m, err := compileRepoPattern(pattern)
+	if err != nil {
+		// Callers should have validated the pattern, so match nothing.
+		m = &repoMatcher{exact: "\x00"}
+	}
+	if repoMatchers.m == nil {
+		repoMatchers.m = map[string]*repoMatcher{}
+	}
+	repoMatchers.m[pattern] = m
+	return m
+}
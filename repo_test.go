@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+func TestRepoMatcher(t *testing.T) {
+	repos := []string{"github.com/acme/api", "github.com/acme/grapi", "github.com/acme/rapid-tools", "github.com/acme/api-docs"}
+	cases := []struct {
+		Pattern string
+		Want    []int
+	}{
+		{"api", []int{0, 1, 2, 3}},
+		{"^github.com/acme/api$", []int{0}},
+		{"/api$", []int{0}},
+		{"(gr|r)api", []int{1, 2}},
+		{"=github.com/acme/api", []int{0}},
+		{"=api", nil},
+		{"api*", []int{0, 3}},
+		{"acme/*api", []int{0, 1}},
+		{"github.com/**/api-*", []int{3}},
+		{"~acmgrapi", []int{1}},
+		{"~rpdtls", []int{2}},
+	}
+	for _, tt := range cases {
+		m, err := compileRepoPattern(tt.Pattern)
+		if err != nil {
+			t.Fatal(tt.Pattern, err)
+		}
+		var got []int
+		for i, repo := range repos {
+			if m.Match(repo) {
+				got = append(got, i)
+			}
+		}
+		if !equalInts(got, tt.Want) {
+			t.Errorf("repo:%s matched %v != %v", tt.Pattern, got, tt.Want)
+		}
+	}
+
+	if _, _, err := parseQuery("foo repo:(api"); err == nil {
+		t.Error("expected error for invalid repo regex")
+	}
+}
+
+func TestRepoMatcherIndex(t *testing.T) {
+	cases := []struct {
+		Pattern string
+		Repo    string
+		Want    int
+	}{
+		{"api", "github.com/api/api", 15},
+		{"a.i", "github.com/api/api", -1},
+		{"a.i$", "github.com/api/api", 15},
+		{"api$", "github.com/api/api", 15},
+		{"ap?", "github.com/api/api", 15},
+		{"github.com/*/api", "github.com/api/api", 0},
+		{"*/api", "github.com/api/api", 11},
+		{"nope", "github.com/api/api", -1},
+	}
+	for _, tt := range cases {
+		m, err := compileRepoPattern(tt.Pattern)
+		if err != nil {
+			t.Fatal(tt.Pattern, err)
+		}
+		if got := m.Index(tt.Repo); got != tt.Want {
+			t.Errorf("repo:%s Index(%q) == %d != %d", tt.Pattern, tt.Repo, got, tt.Want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRepoMatcherScore(t *testing.T) {
+	// Substrings complete fuzzily, other patterns prefer matches near the
+	// end of the name.
+	cases := []struct {
+		Pattern string
+		Order   []string
+	}{
+		{"kcsrgp", []string{"github.com/keegancsmith/rgp", "github.com/kc/sourcegraph-proxy"}},
+		{"rgp", []string{"github.com/keegancsmith/rgp", "github.com/keegancsmith/regexp"}},
+		{"ac+me", []string{"github.com/tools/acme", "github.com/acme/tools"}},
+	}
+	for _, tt := range cases {
+		m, err := compileRepoPattern(tt.Pattern)
+		if err != nil {
+			t.Fatal(tt.Pattern, err)
+		}
+		prev := 0
+		for i, repo := range tt.Order {
+			score, ok := m.Score(repo)
+			if !ok {
+				t.Errorf("repo:%s did not score %s", tt.Pattern, repo)
+				continue
+			}
+			if i > 0 && score >= prev {
+				t.Errorf("repo:%s scored %s (%d) above %s (%d)", tt.Pattern, repo, score, tt.Order[i-1], prev)
+			}
+			prev = score
+		}
+	}
+}
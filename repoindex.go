@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keegancsmith/rgp/internal/fastwalk"
+)
+
+// repoIndex is the on-disk cache of the repositories found in each SRCPATH
+// root. A root's entry stays valid as long as none of the directories walked
+// to find its repositories have changed: cloning, moving or removing a
+// repository always updates the mtime of its parent directory. The git
+// configs names are read from are checked too.
+type repoIndex struct {
+	Version int
+	Roots   map[string]*rootIndex
+}
+
+// repoIndexVersion is bumped whenever the information stored about a repo
+// changes, so older indexes are rebuilt.
+const repoIndexVersion = 3
+
+type rootIndex struct {
+	// Nested and MaxDepth are the walkOptions used to build the index.
+	Nested   bool
+	MaxDepth int
+
+	Repos []repoPath
+	// Mtimes maps each directory walked to find repositories, and each git
+	// config read, to its mtime in nanoseconds.
+	Mtimes map[string]int64
+}
+
+func repoIndexPath() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "repos.json"), nil
+}
+
+// loadRepoIndex reads the repo index. A missing or corrupt index is treated
+// as empty.
+func loadRepoIndex() *repoIndex {
+	idx := &repoIndex{}
+	if path, err := repoIndexPath(); err == nil {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			if err := json.Unmarshal(b, idx); err != nil && debug {
+				log.Println("ignoring corrupt repo index:", err)
+			}
+		}
+	}
+	if idx.Roots == nil || idx.Version != repoIndexVersion {
+		idx.Roots = map[string]*rootIndex{}
+	}
+	return idx
+}
+
+// save writes the index, dropping roots which are no longer in SRCPATH.
+func (idx *repoIndex) save(roots []string) error {
+	path, err := repoIndexPath()
+	if err != nil {
+		return err
+	}
+	keep := &repoIndex{Version: repoIndexVersion, Roots: map[string]*rootIndex{}}
+	for _, root := range roots {
+		if r, ok := idx.Roots[root]; ok {
+			keep.Roots[root] = r
+		}
+	}
+	return writeJSONFile(path, keep)
+}
+
+// fresh reports whether every file read to build r is unchanged.
+func (r *rootIndex) fresh() bool {
+	if len(r.Mtimes) == 0 {
+		return false
+	}
+	for path, mtime := range r.Mtimes {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().UnixNano() != mtime {
+			return false
+		}
+	}
+	return true
+}
+
+// walkSRCPath sends the repositories in each SRCPATH root on the returned
+// channel. Roots which are unchanged since they were last walked are read
+// from the repo index instead. The walk stops once ctx is done, sending
+// ctx.Err() if the receiver is still listening.
+func walkSRCPath(ctx context.Context) <-chan repoPath {
+	c := make(chan repoPath, 8)
+	send := func(rp repoPath) bool {
+		select {
+		case c <- rp:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(c)
+		roots := srcpaths()
+		opts := srcpathWalkOptions()
+		idx := loadRepoIndex()
+		dirty := false
+		for _, srcpath := range roots {
+			r, ok := idx.Roots[srcpath]
+			if !ok || r.Nested != opts.Nested || r.MaxDepth != opts.MaxDepth || !r.fresh() {
+				var err error
+				r, err = walkRepos(ctx, srcpath, opts)
+				if err != nil {
+					send(repoPath{Err: err})
+					return
+				}
+				// Relative roots depend on the working directory,
+				// so are always walked.
+				if filepath.IsAbs(srcpath) {
+					idx.Roots[srcpath] = r
+					dirty = true
+				}
+			}
+			for _, rp := range r.Repos {
+				if !send(rp) {
+					return
+				}
+			}
+		}
+		if dirty {
+			if err := idx.save(roots); err != nil && debug {
+				log.Println("failed to save repo index:", err)
+			}
+		}
+	}()
+	return c
+}
+
+// walkOptions configure how a SRCPATH root is walked.
+type walkOptions struct {
+	// Nested is true if repos inside other repos are discovered.
+	Nested bool
+
+	// Workers is the number of directories read at once. Zero is the
+	// fastwalk default.
+	Workers int
+
+	// MaxDepth is how many directories below the root repos can be. Zero
+	// means no limit.
+	MaxDepth int
+}
+
+// srcpathWalkOptions returns the options from the environment and the walk
+// section of the config file.
+func srcpathWalkOptions() walkOptions {
+	opts := walkOptions{Nested: nestedRepos()}
+	if c, err := loadConfig(); err == nil {
+		opts.Workers = c.Walk.Workers
+		opts.MaxDepth = c.Walk.MaxDepth
+	}
+	return opts
+}
+
+// nestedRepos returns true if RGP_NESTED is set, in which case repos inside
+// other repos (eg submodules or vendored clones) are also discovered. This
+// walks every directory of every repo, so is opt-in.
+func nestedRepos() bool {
+	nested, _ := strconv.ParseBool(os.Getenv("RGP_NESTED"))
+	return nested
+}
+
+// walkRepos walks srcpath and returns the index entry for it. With
+// opts.Nested it also descends into repos, recording which repos contain
+// others. Symlinks to directories are followed. Repos outside srcpath are
+// found, but not descended into.
+func walkRepos(ctx context.Context, srcpath string, opts walkOptions) (*rootIndex, error) {
+	resolved, err := filepath.EvalSymlinks(srcpath)
+	if err != nil {
+		resolved = srcpath
+	}
+	w := &repoWalker{
+		srcpath:  srcpath,
+		resolved: resolved,
+		nested:   opts.Nested,
+		root:     &rootIndex{Nested: opts.Nested, MaxDepth: opts.MaxDepth, Mtimes: map[string]int64{}},
+		repos:    map[string]*repoPath{},
+		ids:      map[string]fileID{},
+		links:    map[string]bool{},
+	}
+	if opts.Nested {
+		w.ignore = newIgnoreTree()
+	}
+	fopts := &fastwalk.Options{NumWorkers: opts.Workers, MaxDepth: opts.MaxDepth}
+	if err := fastwalk.WalkContext(ctx, srcpath, fopts, w.walkFn); err != nil {
+		return nil, err
+	}
+	w.dedupe()
+
+	// A repo's callback runs before its directory is read, so every
+	// parent is in w.repos by now.
+	for path, rp := range w.repos {
+		for dir := filepath.Dir(path); len(dir) > len(srcpath); dir = filepath.Dir(dir) {
+			if parent, ok := w.repos[dir]; ok {
+				rp.Parent = parent.Repo
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return nil, err
+				}
+				parent.Children = append(parent.Children, rel)
+				break
+			}
+		}
+	}
+	r := w.root
+	for _, rp := range w.repos {
+		sort.Strings(rp.Children)
+		r.Repos = append(r.Repos, *rp)
+	}
+	sort.Slice(r.Repos, func(i, j int) bool {
+		return r.Repos[i].Repo < r.Repos[j].Repo
+	})
+	return r, nil
+}
+
+type repoWalker struct {
+	srcpath string
+	// resolved is srcpath with symlinks evaluated, to tell which symlinks
+	// point outside of it.
+	resolved string
+	nested   bool
+	// ignore is used to skip ignored directories, such as node_modules,
+	// when nested.
+	ignore *ignoreTree
+
+	mu    sync.Mutex
+	root  *rootIndex
+	repos map[string]*repoPath
+	// ids are the file IDs of the directories visited, used to detect
+	// symlink cycles and repos reachable by more than one path.
+	ids map[string]fileID
+	// links are the visited directories which are symlinks, mapped to
+	// whether they point outside of srcpath.
+	links map[string]bool
+}
+
+func (w *repoWalker) walkFn(path string, typ os.FileMode) error {
+	switch typ {
+	case os.ModeDir:
+		return w.visitDir(path, false)
+	case os.ModeSymlink:
+		err := w.visitDir(path, true)
+		if err == nil {
+			return fastwalk.ErrTraverseLink
+		}
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// visitDir records path if it is a repo, and returns filepath.SkipDir if
+// the walk should not descend into it.
+func (w *repoWalker) visitDir(path string, link bool) error {
+	if base := filepath.Base(path); len(base) > 0 && base[0] == '.' {
+		return filepath.SkipDir
+	}
+
+	// fastwalk calls us before reading path, so any change made while
+	// walking it is caught on the next run.
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() {
+		// Broken symlinks and symlinks to files.
+		return filepath.SkipDir
+	}
+	id, hasID := getFileID(fi)
+	if link && (!hasID || w.isAncestor(path, id)) {
+		return filepath.SkipDir
+	}
+	// Directories out of SRCPATH, reached through a symlink, are walked
+	// to find the repos in them, but those repos are not walked even when
+	// nested. walk.maxdepth bounds how deep the walk goes.
+	outside := w.outside(path, link)
+
+	d, ok := detectRepo(path)
+	if !ok && w.ignore != nil && w.ignore.ignored(path, true) {
+		return filepath.SkipDir
+	}
+	// The directory is only read, and so its mtime only matters, if it
+	// may contain repos.
+	descend := !ok || (w.nested && !outside)
+	var name, config string
+	var configMtime int64
+	if ok {
+		// Not only git repos have a git directory, jj colocates its
+		// repo with one.
+		name, config, configMtime = gitRemoteName(path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if hasID {
+		w.ids[path] = id
+	}
+	if link {
+		w.links[path] = outside
+	}
+	if descend {
+		w.root.Mtimes[path] = fi.ModTime().UnixNano()
+	}
+	if !ok {
+		return nil
+	}
+
+	repo, err := filepath.Rel(w.srcpath, path)
+	if err != nil {
+		return err
+	}
+	w.repos[path] = &repoPath{
+		Repo: repo,
+		Name: name,
+		Path: path,
+		VCS:  d.VCS,
+		Bare: d.Bare,
+	}
+	if config != "" {
+		w.root.Mtimes[config] = configMtime
+	}
+	if descend {
+		return nil
+	}
+	return filepath.SkipDir
+}
+
+// outside returns true if path is out of SRCPATH, ie it is below a symlink
+// pointing outside of it. link is true if path itself is a symlink.
+func (w *repoWalker) outside(path string, link bool) bool {
+	w.mu.Lock()
+	for dir := filepath.Dir(path); len(dir) > len(w.srcpath); dir = filepath.Dir(dir) {
+		if w.links[dir] {
+			w.mu.Unlock()
+			return true
+		}
+	}
+	w.mu.Unlock()
+	if !link {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(w.resolved, target)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// gitRemoteName returns the canonical name of the git repo at path, based on
+// its origin remote, along with the config file read and its mtime.
+func gitRemoteName(path string) (name, config string, mtime int64) {
+	dir, err := gitDir(path)
+	if err != nil {
+		return "", "", 0
+	}
+	config = gitConfigPath(dir)
+	fi, err := os.Stat(config)
+	if err != nil {
+		return "", "", 0
+	}
+	if remote, err := gitConfigValue(config, "remote.origin.url"); err == nil {
+		name = canonicalRepoName(remote)
+	}
+	return name, config, fi.ModTime().UnixNano()
+}
+
+// isAncestor returns true if the directory id is an ancestor of path, ie
+// following the symlink path would loop.
+func (w *repoWalker) isAncestor(path string, id fileID) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if w.ids[dir] == id {
+			return true
+		}
+		if len(dir) <= len(w.srcpath) {
+			return false
+		}
+	}
+}
+
+// dedupe removes repos reachable by more than one path. The path with the
+// fewest symlinks is kept, then the shortest.
+func (w *repoWalker) dedupe() {
+	best := map[fileID]string{}
+	for path := range w.repos {
+		id, ok := w.ids[path]
+		if !ok {
+			continue
+		}
+		other, ok := best[id]
+		if !ok {
+			best[id] = path
+			continue
+		}
+		if w.preferPath(path, other) {
+			best[id] = path
+			other, path = path, other
+		}
+		delete(w.repos, path)
+	}
+}
+
+func (w *repoWalker) preferPath(a, b string) bool {
+	if la, lb := w.linkCount(a), w.linkCount(b); la != lb {
+		return la < lb
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func (w *repoWalker) linkCount(path string) int {
+	n := 0
+	for ; len(path) > len(w.srcpath); path = filepath.Dir(path) {
+		if _, ok := w.links[path]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// repoRefreshInterval is how stale the REPL's list of repositories may get
+// before it is refreshed in the background.
+const repoRefreshInterval = 5 * time.Second
+
+var completion struct {
+	sync.Mutex
+	ctx        context.Context // cancels background walks
+	loaded     chan struct{}   // closed once the first walk is done
+	refreshing bool
+	refreshed  time.Time
+	repos      []repoPath
+}
+
+// startCompletionRepos starts walking SRCPATH for completion in the
+// background, without waiting for it. Walks stop once ctx is done.
+func startCompletionRepos(ctx context.Context) {
+	completion.Lock()
+	defer completion.Unlock()
+	completion.ctx = ctx
+	refreshCompletionReposLocked()
+}
+
+// completionRepos returns the repositories to use for completion. SRCPATH is
+// walked in the background, so the completer never starts a walk of its own:
+// the first call waits for the first walk until ctx is done, later calls
+// return the last list and refresh it if it is stale.
+func completionRepos(ctx context.Context) []repoPath {
+	completion.Lock()
+	refreshCompletionReposLocked()
+	loaded := completion.loaded
+	completion.Unlock()
+
+	select {
+	case <-loaded:
+	case <-ctx.Done():
+		return nil
+	}
+	completion.Lock()
+	defer completion.Unlock()
+	return completion.repos
+}
+
+// refreshCompletionReposLocked starts a walk of SRCPATH if there is no
+// list of repos yet, or it is stale. completion must be locked.
+func refreshCompletionReposLocked() {
+	if completion.ctx == nil {
+		completion.ctx = context.Background()
+	}
+	if completion.loaded == nil {
+		completion.loaded = make(chan struct{})
+		completion.refreshing = true
+		go refreshCompletionRepos(completion.ctx)
+	} else if !completion.refreshing && time.Since(completion.refreshed) > repoRefreshInterval {
+		completion.refreshing = true
+		go refreshCompletionRepos(completion.ctx)
+	}
+}
+
+func refreshCompletionRepos(ctx context.Context) {
+	repos := collectRepos(ctx)
+	completion.Lock()
+	defer completion.Unlock()
+	completion.refreshing = false
+	if ctx.Err() != nil {
+		// Keep the last complete list.
+		return
+	}
+	completion.repos = repos
+	completion.refreshed = time.Now()
+	select {
+	case <-completion.loaded:
+	default:
+		close(completion.loaded)
+	}
+}
+
+func collectRepos(ctx context.Context) []repoPath {
+	var repos []repoPath
+	for rp := range walkSRCPath(ctx) {
+		if rp.Err != nil {
+			if ctx.Err() == nil {
+				log.Println("srcpath walk failed:", rp.Err)
+			}
+			continue
+		}
+		repos = append(repos, rp)
+	}
+	return repos
+}
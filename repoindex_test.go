@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRepoIndex(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	defer os.Setenv("SRCPATH", os.Getenv("SRCPATH"))
+	os.Setenv("SRCPATH", srcpath)
+	cache, err := ioutil.TempDir("", "rgp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	clone := func(repo string) {
+		if err := os.MkdirAll(filepath.Join(srcpath, repo, ".git"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func() []string {
+		var repos []string
+		for rp := range walkSRCPath(context.Background()) {
+			if rp.Err != nil {
+				t.Fatal(rp.Err)
+			}
+			repos = append(repos, rp.Repo)
+		}
+		sort.Strings(repos)
+		return repos
+	}
+
+	clone("github.com/acme/api")
+	clone("github.com/acme/web")
+	if got, want := walk(), []string{"github.com/acme/api", "github.com/acme/web"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("walk got %v want %v", got, want)
+	}
+
+	idx := loadRepoIndex()
+	r, ok := idx.Roots[srcpath]
+	if !ok {
+		t.Fatal("srcpath not indexed")
+	}
+	if !r.fresh() {
+		t.Fatal("index should be fresh after walk")
+	}
+
+	// A fresh index is used instead of walking.
+	r.Repos = append(r.Repos, repoPath{Repo: "cached", Path: filepath.Join(srcpath, "cached")})
+	if err := idx.save([]string{srcpath}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := walk(), []string{"cached", "github.com/acme/api", "github.com/acme/web"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("cached walk got %v want %v", got, want)
+	}
+
+	// Cloning changes the parent directory, which invalidates the index.
+	clone("github.com/acme/tools")
+	if loadRepoIndex().Roots[srcpath].fresh() {
+		t.Fatal("index should be stale after clone")
+	}
+	if got, want := walk(), []string{"github.com/acme/api", "github.com/acme/tools", "github.com/acme/web"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("walk after clone got %v want %v", got, want)
+	}
+}
+
+func TestNestedRepos(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	for _, dir := range []string{"app/.git", "app/vendor/lib/.git", "app/vendor/lib/sub/.hg", "app/third_party/dep/.git", "app/node_modules/pkg/.git", "other/.git"} {
+		if err := os.MkdirAll(filepath.Join(srcpath, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcpath, "app/.gitignore"), []byte("node_modules/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := walkRepos(context.Background(), srcpath, walkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Repos) != 2 {
+		t.Fatalf("expected only top-level repos, got %v", r.Repos)
+	}
+
+	r, err = walkRepos(context.Background(), srcpath, walkOptions{Nested: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type rel struct {
+		Parent   string
+		Children []string
+	}
+	got := map[string]rel{}
+	for _, rp := range r.Repos {
+		got[rp.Repo] = rel{rp.Parent, rp.Children}
+	}
+	want := map[string]rel{
+		"app":                 {"", []string{"third_party/dep", "vendor/lib"}},
+		"app/third_party/dep": {"app", nil},
+		"app/vendor/lib":      {"app", []string{"sub"}},
+		"app/vendor/lib/sub":  {"app/vendor/lib", nil},
+		"other":               {"", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	// Ignored directories are not walked, so changes to them do not
+	// matter.
+	for _, dir := range []string{"app/node_modules", "app/node_modules/pkg"} {
+		if _, ok := r.Mtimes[filepath.Join(srcpath, dir)]; ok {
+			t.Errorf("ignored directory %s was walked", dir)
+		}
+	}
+
+	// Adding a repo inside another invalidates a nested index.
+	if err := os.MkdirAll(filepath.Join(srcpath, "app/vendor/new/.git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if r.fresh() {
+		t.Error("nested index should be stale after adding a nested repo")
+	}
+}
+
+func TestSymlinkRepos(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	external, err := ioutil.TempDir("", "rgp-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(external)
+
+	for _, dir := range []string{
+		filepath.Join(srcpath, "github.com/acme/api/.git"),
+		filepath.Join(external, "lib/.git"),
+		filepath.Join(external, "lib/vendor/dep/.git"),
+		filepath.Join(external, "deep/tree/app/.git"),
+	} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"api":                  filepath.Join(srcpath, "github.com/acme/api"),
+		"ext":                  filepath.Join(external, "lib"),
+		"home":                 external,
+		"github.com/acme/loop": srcpath,
+		"broken":               filepath.Join(srcpath, "nonexistent"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(srcpath, link)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+
+	fi, err := os.Stat(srcpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hasID := getFileID(fi)
+
+	cases := []struct {
+		Opts walkOptions
+		Want []string
+	}{
+		// home/lib is the same repo as ext, which has fewer path
+		// components.
+		{walkOptions{}, []string{"ext", "github.com/acme/api", "home/deep/tree/app"}},
+		{walkOptions{MaxDepth: 3}, []string{"ext", "github.com/acme/api"}},
+		// Repos outside of SRCPATH are not descended into.
+		{walkOptions{Nested: true}, []string{"ext", "github.com/acme/api", "home/deep/tree/app"}},
+	}
+	for _, tt := range cases {
+		r, err := walkRepos(context.Background(), srcpath, tt.Opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rp := range r.Repos {
+			got = append(got, rp.Repo)
+		}
+		want := tt.Want
+		if !hasID {
+			// symlinks are only followed if we can detect cycles
+			want = []string{"github.com/acme/api"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v got %v want %v", tt.Opts, got, want)
+		}
+	}
+}
+
+func TestRepoRemoteNames(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+
+	repos := map[string]string{
+		"api":   "git@github.com:acme/api.git",
+		"jj":    "https://github.com/acme/web",
+		"plain": "",
+	}
+	for repo, remote := range repos {
+		if err := os.MkdirAll(filepath.Join(srcpath, repo, ".git"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if remote == "" {
+			continue
+		}
+		config := "[remote \"origin\"]\n\turl = " + remote + "\n"
+		if err := ioutil.WriteFile(filepath.Join(srcpath, repo, ".git", "config"), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A jj repo colocated with git.
+	if err := os.Mkdir(filepath.Join(srcpath, "jj", ".jj"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := walkRepos(context.Background(), srcpath, walkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rp := range r.Repos {
+		got = append(got, rp.Repo+" "+rp.VCS+" "+rp.Name)
+	}
+	want := []string{"api git github.com/acme/api", "jj jj github.com/acme/web", "plain git "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestWalkReposOptions(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	for _, dir := range []string{"shallow/.git", "github.com/acme/api/.git", "very/deep/tree/of/repos/.git"} {
+		if err := os.MkdirAll(filepath.Join(srcpath, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := walkRepos(context.Background(), srcpath, walkOptions{Workers: 1, MaxDepth: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rp := range r.Repos {
+		got = append(got, rp.Repo)
+	}
+	if want := []string{"github.com/acme/api", "shallow"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MaxDepth 3 got %v want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := walkRepos(ctx, srcpath, walkOptions{}); err != context.Canceled {
+		t.Errorf("expected cancelled walk to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestCompletionRepos(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "rgp-srcpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+	if err := os.MkdirAll(filepath.Join(srcpath, "api/.git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("SRCPATH", os.Getenv("SRCPATH"))
+	os.Setenv("SRCPATH", srcpath)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", srcpath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startCompletionRepos(ctx)
+
+	wait, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	var got []string
+	for _, rp := range completionRepos(wait) {
+		got = append(got, rp.Repo)
+	}
+	if want := []string{"api"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/google/zoekt/query"
+)
+
+// repoInfo is the metadata rgp repos reports for a repo. Branch is the
+// closest equivalent for VCSs without git branches, eg the jj bookmarks or
+// svn path of the working copy.
+type repoInfo struct {
+	Name      string `json:"name"`
+	Canonical string `json:"canonical,omitempty"`
+	Path      string `json:"path"`
+	VCS       string `json:"vcs"`
+	Branch    string `json:"branch,omitempty"`
+	Head      string `json:"head,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Dirty     bool   `json:"dirty"`
+	Remote    string `json:"remote,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// repoInfoWorkers is how many repos rgp repos inspects at once.
+const repoInfoWorkers = 8
+
+// reposCommand implements rgp repos [--json] [QUERY]. QUERY may only
+// contain atoms which select repos, eg repo: and vcs:.
+func reposCommand(args []string) int {
+	fs := flag.NewFlagSet("repos", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "print repos as a JSON array")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "USAGE: %s repos [--json] [repo:PATTERN vcs:VCS ...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Lists the repos in SRCPATH with their branch, HEAD, dirty state and remote.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	repos, err := selectedRepos(strings.Join(fs.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	infos := repoInfos(repos)
+	if *jsonOut {
+		err = writeRepoInfosJSON(os.Stdout, infos)
+	} else {
+		err = writeRepoInfosTable(os.Stdout, infos)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(infos) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// selectedRepos returns the repos in SRCPATH selected by rawQ. An empty
+// query selects every repo.
+func selectedRepos(rawQ string) ([]repoPath, error) {
+	var q query.Q = &query.Const{Value: true}
+	if rawQ != "" {
+		var err error
+		q, _, err = parseQuery(rawQ)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var repos []repoPath
+	for rp := range walkSRCPath(context.Background()) {
+		if rp.Err != nil {
+			return nil, rp.Err
+		}
+		ok, err := selectsRepo(q, rp)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			repos = append(repos, rp)
+		}
+	}
+	return repos, nil
+}
+
+// selectsRepo returns true if q matches rp. It is an error for q to contain
+// atoms which match content.
+func selectsRepo(q query.Q, rp repoPath) (bool, error) {
+	c, ok := simplifyRepoQuery(q, rp).(*query.Const)
+	if !ok {
+		return false, fmt.Errorf("rgp repos only accepts atoms which select repos, eg repo: and vcs:, got %s", q)
+	}
+	return c.Value, nil
+}
+
+// repoInfos inspects repos concurrently, returning the infos in the same
+// order.
+func repoInfos(repos []repoPath) []*repoInfo {
+	infos := make([]*repoInfo, len(repos))
+	sem := make(chan struct{}, repoInfoWorkers)
+	var wg sync.WaitGroup
+	for i := range repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			infos[i] = inspectRepo(repos[i])
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	return infos
+}
+
+func inspectRepo(rp repoPath) *repoInfo {
+	info := &repoInfo{
+		Name:      rp.Repo,
+		Canonical: rp.Name,
+		Path:      rp.Path,
+		VCS:       rp.VCS,
+	}
+	if rp.VCS == "git" {
+		inspectGit(info, rp)
+		return info
+	}
+	inspect, ok := vcsInspectors[rp.VCS]
+	if !ok {
+		info.Error = fmt.Sprintf("inspecting %s repos is not supported", rp.VCS)
+		return info
+	}
+	if err := inspect(info, rp.Path); err != nil {
+		info.Error = err.Error()
+	}
+	if info.Remote != "" {
+		info.Remote = redactRemote(info.Remote)
+	}
+	return info
+}
+
+func inspectGit(info *repoInfo, rp repoPath) {
+	dir, err := gitDir(rp.Path)
+	if err != nil {
+		info.Error = err.Error()
+		return
+	}
+	info.Branch, _ = gitBranch(dir)
+	if remote, err := gitConfigValue(gitConfigPath(dir), "remote.origin.url"); err == nil {
+		info.Remote = redactRemote(remote)
+	}
+	if info.Head, err = gitHead(dir); err != nil {
+		// A repo without commits has no HEAD yet.
+		info.Head = ""
+		return
+	}
+
+	if out, err := gitOutput(rp.Path, "log", "-1", "--format=%cI", info.Head); err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Date = strings.TrimSpace(out)
+	}
+	if !rp.Bare {
+		if out, err := gitOutput(rp.Path, "status", "--porcelain"); err != nil {
+			info.Error = err.Error()
+		} else {
+			info.Dirty = out != ""
+		}
+	}
+}
+
+// vcsInspectors fill in the repoInfo of a repo at a path using the command
+// line tool of its VCS. Like git, Head is the commit the working copy is
+// based on and Dirty includes untracked files.
+var vcsInspectors = map[string]func(info *repoInfo, dir string) error{
+	"hg":     inspectHg,
+	"svn":    inspectSvn,
+	"jj":     inspectJj,
+	"fossil": inspectFossil,
+}
+
+func inspectHg(info *repoInfo, dir string) error {
+	out, err := vcsOutput(dir, "hg", "log", "-r", ".", "--template", "{node}\n{branch}\n{date|rfc3339date}\n")
+	if err != nil {
+		return err
+	}
+	if f := strings.Split(out, "\n"); len(f) >= 3 && strings.Trim(f[0], "0") != "" {
+		// The null revision means there are no commits yet.
+		info.Head, info.Branch, info.Date = f[0], f[1], f[2]
+	}
+	if out, err = vcsOutput(dir, "hg", "status"); err != nil {
+		return err
+	}
+	info.Dirty = out != ""
+	if out, err := vcsOutput(dir, "hg", "paths", "default"); err == nil {
+		info.Remote = strings.TrimSpace(out)
+	}
+	return nil
+}
+
+func inspectSvn(info *repoInfo, dir string) error {
+	out, err := vcsOutput(dir, "svn", "info", "--xml")
+	if err != nil {
+		return err
+	}
+	var v struct {
+		Entry struct {
+			Revision    string `xml:"revision,attr"`
+			URL         string `xml:"url"`
+			RelativeURL string `xml:"relative-url"`
+			Commit      struct {
+				Date string `xml:"date"`
+			} `xml:"commit"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal([]byte(out), &v); err != nil {
+		return fmt.Errorf("svn info: %v", err)
+	}
+	info.Head = v.Entry.Revision
+	info.Branch = strings.TrimPrefix(v.Entry.RelativeURL, "^/")
+	info.Date = v.Entry.Commit.Date
+	info.Remote = v.Entry.URL
+	if out, err = vcsOutput(dir, "svn", "status"); err != nil {
+		return err
+	}
+	info.Dirty = out != ""
+	return nil
+}
+
+func inspectJj(info *repoInfo, dir string) error {
+	// The working copy is itself a commit, @, so we report its parent
+	// and whether @ has any changes.
+	const template = `commit_id ++ "\n" ++ committer.timestamp().format("%Y-%m-%dT%H:%M:%S%:z") ++ "\n" ++ bookmarks.join(",") ++ "\n"`
+	out, err := vcsOutput(dir, "jj", "log", "--no-graph", "-r", "@-", "-T", template)
+	if err != nil {
+		return err
+	}
+	if f := strings.Split(out, "\n"); len(f) >= 3 && strings.Trim(f[0], "0") != "" {
+		// The root commit means there are no commits yet.
+		info.Head, info.Date, info.Branch = f[0], f[1], f[2]
+	}
+	if out, err = vcsOutput(dir, "jj", "log", "--no-graph", "-r", "@", "-T", "empty"); err != nil {
+		return err
+	}
+	info.Dirty = strings.TrimSpace(out) == "false"
+	if out, err := vcsOutput(dir, "jj", "git", "remote", "list"); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[0] == "origin" {
+				info.Remote = f[1]
+			}
+		}
+	}
+	return nil
+}
+
+func inspectFossil(info *repoInfo, dir string) error {
+	out, err := vcsOutput(dir, "fossil", "info")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		// checkout:     5f8b8b9c... 2018-03-01 10:00:00 UTC
+		if f := strings.Fields(line); len(f) >= 4 && f[0] == "checkout:" {
+			info.Head = f[1]
+			info.Date = f[2] + "T" + f[3] + "Z"
+		}
+	}
+	if out, err := vcsOutput(dir, "fossil", "branch", "current"); err == nil {
+		info.Branch = strings.TrimSpace(out)
+	}
+	if out, err = vcsOutput(dir, "fossil", "changes"); err != nil {
+		return err
+	}
+	info.Dirty = out != ""
+	if !info.Dirty {
+		if out, err = vcsOutput(dir, "fossil", "extras"); err != nil {
+			return err
+		}
+		info.Dirty = out != ""
+	}
+	if out, err := vcsOutput(dir, "fossil", "remote"); err == nil && strings.TrimSpace(out) != "off" {
+		info.Remote = strings.TrimSpace(out)
+	}
+	return nil
+}
+
+// redactRemote hides any password in a remote URL.
+func redactRemote(remote string) string {
+	if u, err := url.Parse(remote); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return remote
+}
+
+// gitOutput runs git in dir and returns its stdout.
+func gitOutput(dir string, args ...string) (string, error) {
+	return vcsOutput(dir, "git", args...)
+}
+
+// vcsOutput runs the command name, eg hg, in dir and returns its stdout.
+func vcsOutput(dir, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+			return "", fmt.Errorf("%s %s: %s", name, args[0], strings.TrimSpace(string(e.Stderr)))
+		}
+		return "", fmt.Errorf("%s %s: %v", name, args[0], err)
+	}
+	return string(out), nil
+}
+
+func writeRepoInfosJSON(w io.Writer, infos []*repoInfo) error {
+	if infos == nil {
+		infos = []*repoInfo{}
+	}
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func writeRepoInfosTable(w io.Writer, infos []*repoInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPATH\tVCS\tBRANCH\tHEAD\tDATE\tDIRTY\tREMOTE")
+	for _, info := range infos {
+		head := info.Head
+		if len(head) > 12 {
+			head = head[:12]
+		}
+		date := info.Date
+		if len(date) > 10 {
+			// just the day of an ISO 8601 date
+			date = date[:10]
+		}
+		dirty := ""
+		if info.Dirty {
+			dirty = "dirty"
+		}
+		remote := info.Remote
+		if info.Error != "" {
+			remote = "error: " + info.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.Name, info.Path, info.VCS, info.Branch, head, date, dirty, remote)
+	}
+	return tw.Flush()
+}
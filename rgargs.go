@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rgArgs is the structured form of the ripgrep flags generated by
+// ripgrep(). It lets search backends other than ripgrep run the same
+// search.
+type rgArgs struct {
+	Globs []rgGlob
+	Types []rgType
+
+	// Patterns are regexes in ripgrep's syntax. A line matches if any
+	// pattern matches.
+	Patterns   []string
+	IgnoreCase bool
+	// Invert selects non-matching lines (-v).
+	Invert bool
+
+	Mode rgMode
+}
+
+type rgMode int
+
+const (
+	// modeLines prints matching lines.
+	modeLines rgMode = iota
+	// modeFiles lists every file searched (--files).
+	modeFiles
+	// modeFilesWithMatches lists files with a match.
+	modeFilesWithMatches
+	// modeFilesWithoutMatch lists files without a match.
+	modeFilesWithoutMatch
+)
+
+// rgGlob is a -g or --iglob flag.
+type rgGlob struct {
+	Pattern       string
+	CaseSensitive bool
+	// Negated globs exclude files. They are written with a leading !
+	// on the command line.
+	Negated bool
+}
+
+// rgType is a --type or -T flag, with the globs defining the type.
+type rgType struct {
+	Name    string
+	Globs   []string
+	Negated bool
+}
+
+// parseRgArgs parses flags generated by ripgrep(). It is not a general
+// ripgrep flag parser.
+func parseRgArgs(args []string) (*rgArgs, error) {
+	a := &rgArgs{}
+	typeAdd := map[string][]string{}
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value for %s", flag)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch flag {
+		case "-g", "--iglob":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			g := rgGlob{Pattern: v, CaseSensitive: flag == "-g"}
+			if strings.HasPrefix(g.Pattern, "!") {
+				g.Pattern = g.Pattern[1:]
+				g.Negated = true
+			}
+			a.Globs = append(a.Globs, g)
+		case "--type-add":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			j := strings.Index(v, ":")
+			if j < 0 {
+				return nil, fmt.Errorf("invalid --type-add %q", v)
+			}
+			typeAdd[v[:j]] = append(typeAdd[v[:j]], v[j+1:])
+		case "--type", "-T":
+			name, err := value()
+			if err != nil {
+				return nil, err
+			}
+			globs, ok := typeAdd[name]
+			if !ok {
+				types, err := rgTypeList()
+				if err != nil {
+					return nil, err
+				}
+				globs = types[name]
+			}
+			a.Types = append(a.Types, rgType{Name: name, Globs: globs, Negated: flag == "-T"})
+		case "-e":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			a.Patterns = append(a.Patterns, v)
+		case "-i":
+			a.IgnoreCase = true
+		case "-v":
+			a.Invert = true
+		case "--files":
+			a.Mode = modeFiles
+		case "--files-with-matches", "-l":
+			a.Mode = modeFilesWithMatches
+		case "--files-without-match":
+			a.Mode = modeFilesWithoutMatch
+		default:
+			return nil, fmt.Errorf("unsupported ripgrep flag %q", flag)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// rgMessage is a line of rg --json output. Data is decoded based on Type.
+type rgMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// rgText is how rg --json encodes paths and lines. Text is used if they are
+// valid UTF-8, otherwise Bytes.
+type rgText struct {
+	Text  string `json:"text"`
+	Bytes []byte `json:"bytes"`
+}
+
+func (t rgText) String() string {
+	if t.Bytes != nil {
+		return string(t.Bytes)
+	}
+	return t.Text
+}
+
+// rgBegin starts the messages for a file.
+type rgBegin struct {
+	Path rgText `json:"path"`
+}
+
+// rgMatch is a line which matched. Lines contains more than one line when
+// a match spans lines.
+type rgMatch struct {
+	Path           rgText       `json:"path"`
+	Lines          rgText       `json:"lines"`
+	LineNumber     int          `json:"line_number"`
+	AbsoluteOffset int64        `json:"absolute_offset"`
+	Submatches     []rgSubmatch `json:"submatches"`
+}
+
+// rgContext is a line around a match, printed because of a flag like -C.
+type rgContext rgMatch
+
+// rgSubmatch is a match in rgMatch.Lines, from byte offset Start to End.
+type rgSubmatch struct {
+	Match rgText `json:"match"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// rgEnd ends the messages for a file. BinaryOffset is set if the file was
+// found to be binary.
+type rgEnd struct {
+	Path         rgText  `json:"path"`
+	BinaryOffset *int64  `json:"binary_offset"`
+	Stats        rgStats `json:"stats"`
+}
+
+// rgSummary is the last message, with the stats of the whole search.
+type rgSummary struct {
+	ElapsedTotal rgDuration `json:"elapsed_total"`
+	Stats        rgStats    `json:"stats"`
+}
+
+type rgStats struct {
+	Elapsed           rgDuration `json:"elapsed"`
+	Searches          int64      `json:"searches"`
+	SearchesWithMatch int64      `json:"searches_with_match"`
+	BytesSearched     int64      `json:"bytes_searched"`
+	BytesPrinted      int64      `json:"bytes_printed"`
+	MatchedLines      int64      `json:"matched_lines"`
+	Matches           int64      `json:"matches"`
+}
+
+type rgDuration struct {
+	Secs  int64  `json:"secs"`
+	Nanos int64  `json:"nanos"`
+	Human string `json:"human"`
+}
+
+// decodeRgJSON reads rg --json output from r, calling fn with each message
+// as a *rgBegin, *rgMatch, *rgContext, *rgEnd or *rgSummary. Messages of
+// other types are skipped.
+func decodeRgJSON(r io.Reader, fn func(msg interface{}) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m rgMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding rg --json output: %v", err)
+		}
+		var msg interface{}
+		switch m.Type {
+		case "begin":
+			msg = &rgBegin{}
+		case "match":
+			msg = &rgMatch{}
+		case "context":
+			msg = &rgContext{}
+		case "end":
+			msg = &rgEnd{}
+		case "summary":
+			msg = &rgSummary{}
+		default:
+			continue
+		}
+		if err := json.Unmarshal(m.Data, msg); err != nil {
+			return fmt.Errorf("decoding rg --json %s message: %v", m.Type, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// result converts m into a searchResult, with its path relative to repo.
+func (m *rgMatch) result(repo string, context bool) *searchResult {
+	r := &searchResult{
+		Repo:    repo,
+		Path:    m.Path.String(),
+		Line:    m.LineNumber,
+		Text:    strings.TrimSuffix(m.Lines.String(), "\n"),
+		Context: context,
+	}
+	if repo != "" {
+		if rel, err := filepath.Rel(repo, r.Path); err == nil {
+			r.Path = rel
+		}
+	}
+	for _, s := range m.Submatches {
+		if s.End > len(r.Text) {
+			// The match includes the newline we trimmed.
+			s.End = len(r.Text)
+		}
+		r.Submatches = append(r.Submatches, submatch{Start: s.Start, End: s.End})
+	}
+	if len(r.Submatches) > 0 {
+		r.Column = r.Submatches[0].Start + 1
+	}
+	return r
+}
+
+// formatRgJSON reads rg --json output from r and writes the results found
+// in repo to w with f. If writing fails the rest of r is still read, so
+// ripgrep is not blocked.
+func formatRgJSON(r io.Reader, repo string, f formatter, w io.Writer) error {
+	err := decodeRgJSON(r, func(msg interface{}) error {
+		switch m := msg.(type) {
+		case *rgMatch:
+			return f.format(w, m.result(repo, false))
+		case *rgContext:
+			return f.format(w, (*rgMatch)(m).result(repo, true))
+		case *rgSummary:
+			if debug {
+				log.Printf("rg searched %d files in %s, %d matched", m.Stats.Searches, m.ElapsedTotal.Human, m.Stats.SearchesWithMatch)
+			}
+		}
+		return nil
+	})
+	io.Copy(ioutil.Discard, r)
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// rgJSONOutput is the output of rg --json -C1 -e http -e Serve over a repo at
+// /src/api, with the line containing "Serve" encoded as bytes.
+const rgJSONOutput = `{"type":"begin","data":{"path":{"text":"/src/api/main.go"}}}
+{"type":"context","data":{"path":{"text":"/src/api/main.go"},"lines":{"text":"func main() {\n"},"line_number":2,"absolute_offset":14,"submatches":[]}}
+{"type":"match","data":{"path":{"text":"/src/api/main.go"},"lines":{"text":"\thttp.ListenAndServe(addr, http.DefaultServeMux)\n"},"line_number":3,"absolute_offset":28,"submatches":[{"match":{"text":"http"},"start":1,"end":5},{"match":{"text":"Serve"},"start":15,"end":20},{"match":{"text":"http"},"start":27,"end":31},{"match":{"text":"Serve"},"start":39,"end":44}]}}
+{"type":"end","data":{"path":{"text":"/src/api/main.go"},"binary_offset":null,"stats":{"elapsed":{"secs":0,"nanos":35000,"human":"0.000035s"},"searches":1,"searches_with_match":1,"bytes_searched":80,"bytes_printed":560,"matched_lines":1,"matches":4}}}
+{"type":"begin","data":{"path":{"text":"/src/api/README"}}}
+{"type":"match","data":{"path":{"text":"/src/api/README"},"lines":{"bytes":"U2VydmUgaHR0cAo="},"line_number":7,"absolute_offset":90,"submatches":[{"match":{"text":"Serve"},"start":0,"end":5},{"match":{"text":"http"},"start":6,"end":10}]}}
+{"type":"end","data":{"path":{"text":"/src/api/README"},"binary_offset":null,"stats":{"elapsed":{"secs":0,"nanos":20000,"human":"0.00002s"},"searches":1,"searches_with_match":1,"bytes_searched":100,"bytes_printed":300,"matched_lines":1,"matches":2}}}
+{"data":{"elapsed_total":{"human":"0.002s","nanos":2000000,"secs":0},"stats":{"bytes_printed":860,"bytes_searched":180,"elapsed":{"human":"0.000055s","nanos":55000,"secs":0},"matched_lines":2,"matches":6,"searches":2,"searches_with_match":2}},"type":"summary"}
+`
+
+func TestFormatRgJSON(t *testing.T) {
+	cases := []struct {
+		Formatter formatter
+		Want      string
+	}{{
+		Formatter: vimgrepFormatter{},
+		Want: `/src/api/main.go:3:2:	http.ListenAndServe(addr, http.DefaultServeMux)
+/src/api/README:7:1:Serve http
+`,
+	}, {
+		Formatter: jsonFormatter{},
+		Want: `{"repo":"/src/api","path":"main.go","line":2,"text":"func main() {","context":true}
+{"repo":"/src/api","path":"main.go","line":3,"column":2,"text":"\thttp.ListenAndServe(addr, http.DefaultServeMux)","submatches":[{"start":1,"end":5},{"start":15,"end":20},{"start":27,"end":31},{"start":39,"end":44}]}
+{"repo":"/src/api","path":"README","line":7,"column":1,"text":"Serve http","submatches":[{"start":0,"end":5},{"start":6,"end":10}]}
+`,
+	}}
+	for _, tt := range cases {
+		var buf bytes.Buffer
+		if err := formatRgJSON(strings.NewReader(rgJSONOutput), "/src/api", tt.Formatter, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.Want {
+			t.Errorf("%T got:\n%q\nwant:\n%q", tt.Formatter, got, tt.Want)
+		}
+	}
+
+	if err := formatRgJSON(strings.NewReader(`{"type":"match","data":`), "", vimgrepFormatter{}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error decoding truncated output")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/zoekt/query"
+	"github.com/keegancsmith/rgp/internal/fastwalk"
+)
+
+// symbol is a definition found by indexing a repository.
+type symbol struct {
+	Name string
+	Kind string
+	// Path is slash separated and relative to the root of the repository.
+	Path string
+	Line int
+	Text string
+}
+
+// symbolIndex is the symbols in a repository. Key identifies the state of
+// the repository they were found in, see trigramIndexKey.
+type symbolIndex struct {
+	Key     string
+	Symbols []symbol
+}
+
+func hasSymbolQuery(q query.Q) bool {
+	hasSym := false
+	query.VisitAtoms(q, func(q query.Q) {
+		if _, ok := q.(*query.Symbol); ok {
+			hasSym = true
+		}
+	})
+	return hasSym
+}
+
+// searchSymbols writes the definitions in roots matching q to w, in the
+// --format selected. The human format is the one ripgrep uses for matches.
+// If roots is empty the working directory is searched.
+func searchSymbols(w io.Writer, q query.Q, roots []string) (int, error) {
+	match, err := symbolMatcher(q)
+	if err != nil {
+		return 2, err
+	}
+
+	relative := len(roots) == 0
+	if relative {
+		roots = []string{"."}
+	}
+
+	var f formatter
+	if outputFormat != "human" {
+		f = newFormatter()
+	}
+
+	code := 1
+	for _, root := range roots {
+		idx, err := loadSymbolIndex(root)
+		if err != nil {
+			log.Printf("%s: %v", root, err)
+			code = 2
+			continue
+		}
+		for _, sym := range idx.Symbols {
+			if !match(sym) {
+				continue
+			}
+			if code == 1 {
+				code = 0
+			}
+			r := &searchResult{Path: filepath.FromSlash(sym.Path), Line: sym.Line, Text: sym.Text}
+			if !relative {
+				r.Repo = root
+			}
+			if f == nil {
+				_, err = fmt.Fprintf(w, "%s:%d:%s\n", r.displayPath(), r.Line, r.Text)
+			} else {
+				err = f.format(w, r)
+			}
+			if err != nil {
+				return 2, err
+			}
+		}
+	}
+	return code, nil
+}
+
+// symbolMatcher returns a function which reports whether a symbol matches
+// q. Only symbol atoms and file filters are supported.
+func symbolMatcher(q query.Q) (func(symbol) bool, error) {
+	switch s := q.(type) {
+	case *query.And:
+		matchers, err := symbolMatchers(s.Children)
+		if err != nil {
+			return nil, err
+		}
+		return func(sym symbol) bool {
+			for _, m := range matchers {
+				if !m(sym) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case *query.Or:
+		matchers, err := symbolMatchers(s.Children)
+		if err != nil {
+			return nil, err
+		}
+		return func(sym symbol) bool {
+			for _, m := range matchers {
+				if m(sym) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case *query.Not:
+		m, err := symbolMatcher(s.Child)
+		if err != nil {
+			return nil, err
+		}
+		return func(sym symbol) bool { return !m(sym) }, nil
+	case *query.Const:
+		return func(symbol) bool { return s.Value }, nil
+	case *query.Symbol:
+		pattern := s.Atom.Pattern
+		if !s.Atom.CaseSensitive {
+			pattern = strings.ToLower(pattern)
+		}
+		return func(sym symbol) bool {
+			name := sym.Name
+			if !s.Atom.CaseSensitive {
+				name = strings.ToLower(name)
+			}
+			return strings.Contains(name, pattern)
+		}, nil
+	case *query.Glob:
+		g, err := compileGlob(s.Pattern, s.CaseSensitive)
+		if err != nil {
+			return nil, err
+		}
+		return func(sym symbol) bool { return g.Match(sym.Path) }, nil
+	case *query.Language:
+		globs, err := languageGlobs(s.Language)
+		if err != nil {
+			return nil, err
+		}
+		var gs []*globMatcher
+		for _, glob := range globs {
+			g, err := compileGlob(glob, true)
+			if err != nil {
+				return nil, err
+			}
+			gs = append(gs, g)
+		}
+		return func(sym symbol) bool {
+			for _, g := range gs {
+				if g.Match(sym.Path) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		return nil, fmt.Errorf("sym: can only be combined with file: and lang:, got %s", q)
+	}
+}
+
+func symbolMatchers(qs []query.Q) ([]func(symbol) bool, error) {
+	var matchers []func(symbol) bool
+	for _, q := range qs {
+		m, err := symbolMatcher(q)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// loadSymbolIndex returns the symbols for the repository at root. Indexes
+// for git repositories are cached until HEAD or the working tree changes.
+func loadSymbolIndex(root string) (*symbolIndex, error) {
+	var cachePath string
+	key, err := trigramIndexKey(root)
+	if err == nil {
+		cachePath, _ = symbolCachePath(root)
+	}
+
+	if cachePath != "" {
+		if b, err := ioutil.ReadFile(cachePath); err == nil {
+			var idx symbolIndex
+			if err := json.Unmarshal(b, &idx); err == nil && idx.Key == key {
+				return &idx, nil
+			}
+		}
+	}
+
+	syms, err := buildSymbols(root)
+	if err != nil {
+		return nil, err
+	}
+	idx := &symbolIndex{Key: key, Symbols: syms}
+
+	if cachePath != "" {
+		if err := writeJSONFile(cachePath, idx); err != nil && debug {
+			log.Println("failed to cache symbols:", err)
+		}
+	}
+	return idx, nil
+}
+
+func symbolCachePath(root string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "symbols", hex.EncodeToString(h[:16])+".json"), nil
+}
+
+// writeJSONFile atomically replaces path with v encoded as JSON.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic replaces path with b, so readers never see a partially
+// written file.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// buildSymbols indexes the symbols in root with universal-ctags. If ctags
+// is not installed, only Go files are indexed.
+func buildSymbols(root string) ([]symbol, error) {
+	var (
+		syms []symbol
+		err  error
+	)
+	if _, lookErr := exec.LookPath("ctags"); lookErr == nil {
+		syms, err = ctagsSymbols(root)
+	} else {
+		syms, err = goSymbols(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].Path != syms[j].Path {
+			return syms[i].Path < syms[j].Path
+		}
+		return syms[i].Line < syms[j].Line
+	})
+	return syms, nil
+}
+
+func ctagsSymbols(root string) ([]symbol, error) {
+	// We list the files like ripgrep so we respect ignore files.
+	m, err := newNativeMatcher(&rgArgs{Mode: modeFiles})
+	if err != nil {
+		return nil, err
+	}
+	paths, err := m.walk(newIgnoreTree(), root, false)
+	if err != nil {
+		return nil, err
+	}
+	var list bytes.Buffer
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	for _, p := range paths {
+		list.WriteString(strings.TrimPrefix(p, prefix))
+		list.WriteByte('\n')
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("ctags", "--fields=+nK", "-L", "-", "-f", "-")
+	cmd.Dir = root
+	cmd.Stdin = &list
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ctags failed: %v", err)
+	}
+
+	var syms []symbol
+	sc := bufio.NewScanner(&stdout)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if sym, ok := parseCtagsLine(sc.Text()); ok {
+			syms = append(syms, sym)
+		}
+	}
+	return syms, sc.Err()
+}
+
+// parseCtagsLine parses a line from a ctags file written with --fields=+nK,
+// which looks like
+//
+//	NewServer	server.go	/^func NewServer() *Server {$/;"	function	line:12
+func parseCtagsLine(line string) (symbol, bool) {
+	if strings.HasPrefix(line, "!_") {
+		// pseudo tag
+		return symbol{}, false
+	}
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return symbol{}, false
+	}
+	sym := symbol{Name: parts[0], Path: filepath.ToSlash(parts[1])}
+
+	excmd, fields := parts[2], ""
+	if i := strings.Index(excmd, ";\"\t"); i >= 0 {
+		excmd, fields = excmd[:i], excmd[i+3:]
+	}
+	if strings.HasPrefix(excmd, "/^") {
+		text := strings.TrimSuffix(strings.TrimPrefix(excmd, "/^"), "/")
+		text = strings.TrimSuffix(text, "$")
+		sym.Text = strings.NewReplacer(`\/`, "/", `\\`, `\`).Replace(text)
+	}
+
+	for _, f := range strings.Split(fields, "\t") {
+		if strings.HasPrefix(f, "line:") {
+			sym.Line, _ = strconv.Atoi(strings.TrimPrefix(f, "line:"))
+		} else if f != "" && !strings.Contains(f, ":") {
+			sym.Kind = f
+		}
+	}
+	if sym.Line == 0 {
+		return symbol{}, false
+	}
+	return sym, true
+}
+
+// goSymbols is a minimal built-in indexer which finds the top-level
+// declarations in Go files.
+func goSymbols(root string) ([]symbol, error) {
+	var (
+		mu   sync.Mutex
+		syms []symbol
+	)
+	err := fastwalk.Walk(root, func(path string, typ os.FileMode) error {
+		if typ == os.ModeDir {
+			if base := filepath.Base(path); path != root && (base[0] == '.' || base == "vendor" || base == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !typ.IsRegular() || !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fileSyms, err := goFileSymbols(path)
+		if err != nil {
+			// Ignore files which do not parse, like ctags does.
+			return nil
+		}
+		for i := range fileSyms {
+			fileSyms[i].Path = filepath.ToSlash(rel)
+		}
+		mu.Lock()
+		syms = append(syms, fileSyms...)
+		mu.Unlock()
+		return nil
+	})
+	return syms, err
+}
+
+func goFileSymbols(path string) ([]symbol, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(src), "\n")
+
+	var syms []symbol
+	add := func(name *ast.Ident, kind string) {
+		if name.Name == "_" {
+			return
+		}
+		line := fset.Position(name.Pos()).Line
+		syms = append(syms, symbol{
+			Name: name.Name,
+			Kind: kind,
+			Line: line,
+			Text: strings.TrimSuffix(lines[line-1], "\r"),
+		})
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			kind := "func"
+			if d.Recv != nil {
+				kind = "method"
+			}
+			add(d.Name, kind)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name, "type")
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						add(name, d.Tok.String())
+					}
+				}
+			}
+		}
+	}
+	return syms, nil
+}
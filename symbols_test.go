@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCtagsLine(t *testing.T) {
+	cases := []struct {
+		Line string
+		Want symbol
+		OK   bool
+	}{
+		{
+			"NewServer\tcmd/server.go\t/^func NewServer(a\\/b string) *Server {$/;\"\tfunction\tline:12",
+			symbol{Name: "NewServer", Kind: "function", Path: "cmd/server.go", Line: 12, Text: "func NewServer(a/b string) *Server {"},
+			true,
+		},
+		{
+			"Server\tserver.go\t/^type Server struct {$/;\"\tstruct\tline:3\ttyperef:struct:Server",
+			symbol{Name: "Server", Kind: "struct", Path: "server.go", Line: 3, Text: "type Server struct {"},
+			true,
+		},
+		{"!_TAG_FILE_FORMAT\t2\t/extended format/", symbol{}, false},
+	}
+	for _, tt := range cases {
+		got, ok := parseCtagsLine(tt.Line)
+		if ok != tt.OK || !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("parseCtagsLine(%q) == %+v, %v != %+v, %v", tt.Line, got, ok, tt.Want, tt.OK)
+		}
+	}
+}
+
+func TestGoSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-symbols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := `package server
+
+type Server struct{}
+
+func NewServer() *Server { return nil }
+
+func (s *Server) Serve() {}
+
+const (
+	DefaultPort = 80
+)
+`
+	if err := os.MkdirAll(filepath.Join(dir, "pkg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg", "server.go"), []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := goSymbols(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []symbol{
+		{Name: "Server", Kind: "type", Path: "pkg/server.go", Line: 3, Text: "type Server struct{}"},
+		{Name: "NewServer", Kind: "func", Path: "pkg/server.go", Line: 5, Text: "func NewServer() *Server { return nil }"},
+		{Name: "Serve", Kind: "method", Path: "pkg/server.go", Line: 7, Text: "func (s *Server) Serve() {}"},
+		{Name: "DefaultPort", Kind: "const", Path: "pkg/server.go", Line: 10, Text: "\tDefaultPort = 80"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("goSymbols == %+v != %+v", got, want)
+	}
+}
+
+func TestSymbolMatcher(t *testing.T) {
+	syms := []symbol{
+		{Name: "NewServer", Path: "cmd/server.go"},
+		{Name: "newServerConfig", Path: "cmd/server_test.go"},
+		{Name: "NewServer", Path: "web/server.ts"},
+	}
+	cases := []struct {
+		Query string
+		Want  []int
+	}{
+		{"sym:NewServer", []int{0, 2}},
+		{"sym:newserver", []int{0, 1, 2}},
+		{"sym:newserver f:*.go -f:_test.go", []int{0}},
+		{"sym:NewServer lang:ts", []int{2}},
+		{"sym:Config or sym:NewServer f:cmd/**", []int{0, 1}},
+	}
+	for _, tt := range cases {
+		q, _, err := parseQuery(tt.Query)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		match, err := symbolMatcher(q)
+		if err != nil {
+			t.Fatal(tt.Query, err)
+		}
+		var got []int
+		for i, sym := range syms {
+			if match(sym) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s matched %v != %v", q, got, tt.Want)
+		}
+	}
+
+	q, _, _ := parseQuery("sym:NewServer foo")
+	if _, err := symbolMatcher(q); err == nil {
+		t.Error("expected error combining sym: with a content pattern")
+	}
+}
+
+func TestLoadSymbolIndexWorkingTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "rgp-symbols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := ioutil.TempDir("", "rgp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=rgp", "-c", "user.email=rgp@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	path := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(path, []byte("package a\n\nfunc Old() {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+
+	names := func() []string {
+		idx, err := loadSymbolIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, sym := range idx.Symbols {
+			names = append(names, sym.Name)
+		}
+		return names
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"Old"}) {
+		t.Fatalf("got symbols %v, want [Old]", got)
+	}
+	// An uncommitted edit is seen, even though HEAD is the same.
+	if err := ioutil.WriteFile(path, []byte("package a\n\nfunc Old() {}\n\nfunc New() {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"Old", "New"}) {
+		t.Errorf("got symbols %v after editing, want [Old New]", got)
+	}
+}
+
+func TestSearchSymbolsFormat(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "rgp-symbols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := ioutil.TempDir("", "rgp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "a.go"), []byte("package a\n\nfunc Old() {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "init", "-q")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	path := filepath.Join(dir, "a", "a.go")
+	cases := []struct {
+		Format string
+		Want   string
+	}{
+		{"human", path + ":3:func Old() {}\n"},
+		{"vimgrep", path + ":3:1:func Old() {}\n"},
+		{"json", `{"repo":"` + dir + `","path":"a/a.go","line":3,"text":"func Old() {}"}` + "\n"},
+	}
+	defer func(format string) { outputFormat = format }(outputFormat)
+	q, _, err := parseQuery("sym:Old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range cases {
+		outputFormat = tt.Format
+		var buf bytes.Buffer
+		code, err := searchSymbols(&buf, q, []string{dir})
+		if err != nil {
+			t.Fatal(tt.Format, err)
+		}
+		if code != 0 || buf.String() != tt.Want {
+			t.Errorf("%s: got %d %q, want 0 %q", tt.Format, code, buf.String(), tt.Want)
+		}
+	}
+}
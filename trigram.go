@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/zoekt/query"
+)
+
+// trigramIndex is a zoekt style index of the files in a git repo. For each
+// trigram, three consecutive bytes, it records the files containing it, so
+// a search only reads the files which can match. An index is only used
+// while the repo is in the state Key identifies.
+type trigramIndex struct {
+	Version int
+	Key     string
+	// Files are the files ripgrep would search, sorted by path.
+	Files []indexedFile
+	// Postings maps a trigram to the ids, indexes into Files, of the
+	// files containing it. The ids are sorted and stored as uvarint
+	// deltas.
+	Postings map[uint32][]byte
+
+	// Head and Mtimes let unchanged tell the repo is still in the state
+	// Key identifies without running git status. Mtimes maps each
+	// directory containing indexed files, and each ignore file read, to
+	// its mtime in nanoseconds.
+	Head   string
+	Mtimes map[string]int64
+}
+
+type indexedFile struct {
+	// Path is slash separated and relative to the root of the repo.
+	Path  string
+	Size  int64
+	Mtime int64
+	// Binary files contain a NUL byte, so never have matching lines.
+	Binary bool
+	// Unindexed files are too large to index, so are always searched.
+	Unindexed bool
+}
+
+// trigramIndexVersion is bumped whenever the format of trigramIndex
+// changes, so older indexes are rebuilt.
+const trigramIndexVersion = 3
+
+// maxIndexedFileSize is the size of the largest file whose trigrams are
+// indexed.
+const maxIndexedFileSize = 1 << 20
+
+func trigramIndexPath(root string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "trigrams", hex.EncodeToString(h[:16])+".gob"), nil
+}
+
+// hasTrigramIndex returns true if any of paths has been indexed, fresh or
+// not.
+func hasTrigramIndex(paths []string) bool {
+	for _, path := range paths {
+		if p, err := trigramIndexPath(path); err == nil {
+			if _, err := os.Stat(p); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trigramIndexKey identifies the state of the git repo at root: its HEAD,
+// and the size and mtime of each file git status reports. Committing,
+// checking out, or changing a file which is not ignored changes the key.
+func trigramIndexKey(root string) (string, error) {
+	dir, err := gitDir(root)
+	if err != nil {
+		return "", err
+	}
+	head, err := gitHead(dir)
+	if err != nil {
+		return "", err
+	}
+	out, err := gitOutput(root, "status", "--porcelain", "-z", "--untracked-files=all")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	entries := strings.Split(out, "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00", e)
+		if e[0] == 'R' || e[0] == 'C' {
+			// The next entry is the path it was renamed or copied from.
+			i++
+		}
+		if fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(e[3:]))); err == nil {
+			fmt.Fprintf(h, "%d %d\x00", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return head + "+" + hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// readTrigramIndex reads the index of the repo at root, fresh or not. A
+// missing index, or one in an older format, is nil.
+func readTrigramIndex(root string) (*trigramIndex, error) {
+	path, err := trigramIndexPath(root)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := &trigramIndex{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(idx); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if idx.Version != trigramIndexVersion {
+		return nil, nil
+	}
+	return idx, nil
+}
+
+// loadTrigramIndex returns the index of the repo at root, or nil if there
+// is no index or it is stale.
+func loadTrigramIndex(root string) *trigramIndex {
+	idx, err := readTrigramIndex(root)
+	if err != nil && debug {
+		log.Println("ignoring trigram index:", err)
+	}
+	if idx == nil {
+		return nil
+	}
+	if idx.unchanged(root) {
+		return idx
+	}
+	key, err := trigramIndexKey(root)
+	if err != nil || key != idx.Key {
+		return nil
+	}
+	return idx
+}
+
+// unchanged returns true if HEAD and the files and directories of the repo
+// at root are as they were when idx was built. It is much cheaper than
+// trigramIndexKey, which runs git status, so is checked first. If it returns
+// false the repo may still be in the state idx.Key identifies, eg after a
+// file was touched.
+func (idx *trigramIndex) unchanged(root string) bool {
+	if idx.Head == "" || len(idx.Mtimes) == 0 {
+		return false
+	}
+	dir, err := gitDir(root)
+	if err != nil {
+		return false
+	}
+	if head, err := gitHead(dir); err != nil || head != idx.Head {
+		return false
+	}
+	for path, mtime := range idx.Mtimes {
+		fi, err := os.Lstat(path)
+		if err != nil || fi.ModTime().UnixNano() != mtime {
+			return false
+		}
+	}
+	for _, f := range idx.Files {
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(f.Path)))
+		if err != nil || fi.Size() != f.Size || fi.ModTime().UnixNano() != f.Mtime {
+			return false
+		}
+	}
+	return true
+}
+
+// stamp sets idx.Mtimes for the repo at root with the git directory dir.
+// dirs are the directories read to find the indexed files. Adding or
+// removing a file changes the mtime of its directory, so a new file which
+// is not ignored is noticed.
+func (idx *trigramIndex) stamp(dirs []string, dir string) {
+	idx.Mtimes = map[string]int64{}
+	add := func(path string) {
+		if fi, err := os.Lstat(path); err == nil {
+			idx.Mtimes[path] = fi.ModTime().UnixNano()
+		}
+	}
+	for _, d := range dirs {
+		add(d)
+		for _, name := range []string{".rgignore", ".ignore", ".gitignore"} {
+			add(filepath.Join(d, name))
+		}
+	}
+	add(filepath.Join(dir, "info", "exclude"))
+}
+
+// save writes idx as the index of the repo at root. It is encoded with gob
+// rather than JSON since it can be large.
+func (idx *trigramIndex) save(root string) error {
+	path, err := trigramIndexPath(root)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(idx); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// buildTrigramIndex indexes the git repo at root. Files unchanged since old
+// was built reuse its trigrams, so only updated files are read. updated is
+// the number of files read.
+func buildTrigramIndex(root string, old *trigramIndex) (idx *trigramIndex, updated int, err error) {
+	dir, err := gitDir(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	head, err := gitHead(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := trigramIndexKey(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := newNativeMatcher(&rgArgs{Mode: modeFiles})
+	if err != nil {
+		return nil, 0, err
+	}
+	paths, dirs, err := m.walkTree(newIgnoreTree(), root, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	oldIDs := map[string]int{}
+	if old != nil {
+		for id, f := range old.Files {
+			oldIDs[f.Path] = id
+		}
+	}
+	idx = &trigramIndex{Version: trigramIndexVersion, Key: key, Files: make([]indexedFile, len(paths)), Head: head}
+	// reused maps the ids of reused files in old to their new id.
+	reused := map[uint32]uint32{}
+	var read []int
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	for id, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		f := indexedFile{
+			Path:  filepath.ToSlash(strings.TrimPrefix(p, prefix)),
+			Size:  fi.Size(),
+			Mtime: fi.ModTime().UnixNano(),
+		}
+		if oldID, ok := oldIDs[f.Path]; ok {
+			if o := old.Files[oldID]; o.Size == f.Size && o.Mtime == f.Mtime {
+				idx.Files[id] = o
+				reused[uint32(oldID)] = uint32(id)
+				continue
+			}
+		}
+		if f.Size > maxIndexedFileSize {
+			f.Unindexed = true
+		} else {
+			read = append(read, id)
+		}
+		idx.Files[id] = f
+	}
+
+	// Read the new and changed files concurrently.
+	fileTrigrams := make([][]uint32, len(paths))
+	work := make(chan int)
+	errs := make(chan error, len(read))
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				data, err := ioutil.ReadFile(paths[id])
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if bytes.IndexByte(data, 0) >= 0 {
+					idx.Files[id].Binary = true
+					continue
+				}
+				fileTrigrams[id] = trigrams(data)
+			}
+		}()
+	}
+	for _, id := range read {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, 0, err
+	}
+
+	postings := map[uint32][]uint32{}
+	if old != nil {
+		for t, encoded := range old.Postings {
+			for _, oldID := range decodePostings(encoded) {
+				if id, ok := reused[oldID]; ok {
+					postings[t] = append(postings[t], id)
+				}
+			}
+		}
+	}
+	for id, ts := range fileTrigrams {
+		for _, t := range ts {
+			postings[t] = append(postings[t], uint32(id))
+		}
+	}
+	idx.Postings = make(map[uint32][]byte, len(postings))
+	for t, ids := range postings {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		idx.Postings[t] = encodePostings(ids)
+	}
+	idx.stamp(dirs, dir)
+	return idx, len(read), nil
+}
+
+// foldTrigramText lower cases ASCII letters, and the other runes which
+// case fold to them, so one index serves case sensitive and insensitive
+// searches.
+func foldTrigramText(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case 'A' <= c && c <= 'Z':
+			out = append(out, c+'a'-'A')
+		case c == 0xe2 && i+2 < len(b) && b[i+1] == 0x84 && b[i+2] == 0xaa:
+			// KELVIN SIGN
+			out = append(out, 'k')
+			i += 2
+		case c == 0xc5 && i+1 < len(b) && b[i+1] == 0xbf:
+			// LATIN SMALL LETTER LONG S
+			out = append(out, 's')
+			i++
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// trigrams returns the distinct trigrams of b after folding, sorted.
+func trigrams(b []byte) []uint32 {
+	b = foldTrigramText(b)
+	if len(b) < 3 {
+		return nil
+	}
+	ts := make([]uint32, 0, len(b)-2)
+	for i := 0; i+3 <= len(b); i++ {
+		ts = append(ts, uint32(b[i])<<16|uint32(b[i+1])<<8|uint32(b[i+2]))
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	n := 0
+	for i, t := range ts {
+		if i == 0 || t != ts[n-1] {
+			ts[n] = t
+			n++
+		}
+	}
+	return ts[:n]
+}
+
+func encodePostings(ids []uint32) []byte {
+	buf := make([]byte, 0, len(ids))
+	var tmp [binary.MaxVarintLen32]byte
+	prev := uint32(0)
+	for _, id := range ids {
+		n := binary.PutUvarint(tmp[:], uint64(id-prev))
+		buf = append(buf, tmp[:n]...)
+		prev = id
+	}
+	return buf
+}
+
+func decodePostings(b []byte) []uint32 {
+	var ids []uint32
+	prev := uint32(0)
+	for len(b) > 0 {
+		delta, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		prev += uint32(delta)
+		ids = append(ids, prev)
+		b = b[n:]
+	}
+	return ids
+}
+
+// postingSet is a set of file ids. If all is true it is every file.
+type postingSet struct {
+	all bool
+	ids []uint32
+}
+
+func intersectPostings(a, b postingSet) postingSet {
+	if a.all {
+		return b
+	}
+	if b.all {
+		return a
+	}
+	var ids []uint32
+	for i, j := 0, 0; i < len(a.ids) && j < len(b.ids); {
+		switch {
+		case a.ids[i] < b.ids[j]:
+			i++
+		case a.ids[i] > b.ids[j]:
+			j++
+		default:
+			ids = append(ids, a.ids[i])
+			i++
+			j++
+		}
+	}
+	return postingSet{ids: ids}
+}
+
+func unionPostings(a, b postingSet) postingSet {
+	if a.all || b.all {
+		return postingSet{all: true}
+	}
+	var ids []uint32
+	i, j := 0, 0
+	for i < len(a.ids) && j < len(b.ids) {
+		switch {
+		case a.ids[i] < b.ids[j]:
+			ids = append(ids, a.ids[i])
+			i++
+		case a.ids[i] > b.ids[j]:
+			ids = append(ids, b.ids[j])
+			j++
+		default:
+			ids = append(ids, a.ids[i])
+			i++
+			j++
+		}
+	}
+	ids = append(ids, a.ids[i:]...)
+	ids = append(ids, b.ids[j:]...)
+	return postingSet{ids: ids}
+}
+
+// lookup returns the files which may contain a match for q, a query
+// returned by query.RegexpToQuery. If fold is true the query is case
+// insensitive, so only trigrams which fold exactly are used.
+func (idx *trigramIndex) lookup(q query.Q, fold bool) postingSet {
+	switch s := q.(type) {
+	case *query.Const:
+		return postingSet{all: s.Value}
+	case *query.Substring:
+		set := postingSet{all: true}
+		for _, t := range trigrams([]byte(s.Pattern)) {
+			if fold && (t>>16 >= 0x80 || t>>8&0xff >= 0x80 || t&0xff >= 0x80) {
+				continue
+			}
+			encoded, ok := idx.Postings[t]
+			if !ok {
+				return postingSet{}
+			}
+			set = intersectPostings(set, postingSet{ids: decodePostings(encoded)})
+		}
+		return set
+	case *query.And:
+		set := postingSet{all: true}
+		for _, ch := range s.Children {
+			set = intersectPostings(set, idx.lookup(ch, fold))
+		}
+		return set
+	case *query.Or:
+		var set postingSet
+		for _, ch := range s.Children {
+			set = unionPostings(set, idx.lookup(ch, fold))
+		}
+		return set
+	}
+	return postingSet{all: true}
+}
+
+// candidates returns the ids of the files which may be listed or contain a
+// matching line for a search with a, sorted.
+func (idx *trigramIndex) candidates(a *rgArgs) []uint32 {
+	set := postingSet{all: a.Mode == modeFiles || a.Mode == modeFilesWithoutMatch || a.Invert || len(a.Patterns) == 0}
+	for _, p := range a.Patterns {
+		if set.all {
+			break
+		}
+		flags := syntax.Perl
+		if a.IgnoreCase {
+			flags |= syntax.FoldCase
+		}
+		re, err := syntax.Parse(p, flags)
+		if err != nil {
+			set.all = true
+			break
+		}
+		fold := a.IgnoreCase || strings.Contains(p, "(?i")
+		set = unionPostings(set, idx.lookup(query.RegexpToQuery(re, 3), fold))
+	}
+
+	var ids []uint32
+	for id, f := range idx.Files {
+		if set.all || f.Unindexed {
+			ids = append(ids, uint32(id))
+		}
+	}
+	if !set.all {
+		ids = unionPostings(postingSet{ids: ids}, set).ids
+	}
+	return ids
+}
+
+// search searches the candidate files of the repo at root with m.
+func (idx *trigramIndex) search(m *nativeMatcher, a *rgArgs, root string) ([]rgLine, bool) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rgp: %v\n", err)
+		return nil, false
+	}
+	var files []string
+	for _, id := range idx.candidates(a) {
+		if f := idx.Files[id]; m.selects(absRoot, f.Path) {
+			files = append(files, filepath.Join(root, filepath.FromSlash(f.Path)))
+		}
+	}
+	return m.searchFiles(files, os.Stderr)
+}
+
+// indexBackend searches the repos with a fresh trigramIndex in process, and
+// the other paths with fallback.
+type indexBackend struct {
+	// excludes are globs which exclude nested repos, like
+	// rgBackend.excludes.
+	excludes []string
+	fallback backend
+
+	// indexes caches the index of each path, nil if it is stale, since a
+	// query can search the same paths several times.
+	indexes map[string]*trigramIndex
+}
+
+func (b *indexBackend) index(path string) *trigramIndex {
+	if idx, ok := b.indexes[path]; ok {
+		return idx
+	}
+	if b.indexes == nil {
+		b.indexes = map[string]*trigramIndex{}
+	}
+	idx := loadTrigramIndex(path)
+	b.indexes[path] = idx
+	return idx
+}
+
+func (b *indexBackend) lines(args, paths []string) ([]rgLine, int) {
+	a, err := parseRgArgs(concat(args, b.excludes))
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := newNativeMatcher(a)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		lines []rgLine
+		stale []string
+		code  = 1
+	)
+	for _, path := range paths {
+		idx := b.index(path)
+		if idx == nil {
+			stale = append(stale, path)
+			continue
+		}
+		if explain {
+			explainf("search the trigram index of %s with %s", path, shellQuote(concat(args, b.excludes)))
+			continue
+		}
+		found, ok := idx.search(m, a, path)
+		lines = append(lines, found...)
+		switch {
+		case !ok:
+			code = 2
+		case len(found) > 0:
+			code = combineExitStatus(code, 0)
+		}
+	}
+	if len(stale) > 0 {
+		if explain {
+			explainf("the trigram index of %s is missing or stale", strings.Join(stale, " "))
+		}
+		found, c := b.fallback.lines(args, stale)
+		lines = append(lines, found...)
+		code = combineExitStatus(code, c)
+	}
+	if explain {
+		if a.Mode != modeLines {
+			return []rgLine{{Path: explainFiles}}, 0
+		}
+		return nil, 0
+	}
+	return lines, code
+}
+
+func (b *indexBackend) files(args, paths []string) ([]string, int) {
+	lines, code := b.lines(args, paths)
+	files := make([]string, len(lines))
+	for i, l := range lines {
+		files[i] = l.Path
+	}
+	return files, code
+}
+
+// indexCommand implements rgp index [--clear] [QUERY]. QUERY may only
+// contain atoms which select repos, eg repo: and vcs:.
+func indexCommand(args []string) int {
+	fs := flag.NewFlagSet("index", flag.ContinueOnError)
+	remove := fs.Bool("clear", false, "remove the indexes instead of updating them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "USAGE: %s index [--clear] [repo:PATTERN vcs:VCS ...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Builds or updates the trigram index of each git repo in SRCPATH, so searches")
+		fmt.Fprintln(fs.Output(), "only read the files which can match. Repos whose index is stale are searched")
+		fmt.Fprintln(fs.Output(), "with ripgrep until they are indexed again.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	repos, err := selectedRepos(strings.Join(fs.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	code := 1
+	for _, rp := range repos {
+		if rp.VCS != "git" || rp.Bare {
+			// Only git working trees have a key for their state.
+			continue
+		}
+		if *remove {
+			path, err := trigramIndexPath(rp.Path)
+			if err == nil {
+				err = os.Remove(path)
+			}
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", rp.Repo, err)
+				code = 2
+			} else if code == 1 {
+				code = 0
+			}
+			continue
+		}
+
+		old, err := readTrigramIndex(rp.Path)
+		if err != nil && debug {
+			log.Println("rebuilding trigram index:", err)
+		}
+		idx, updated, err := buildTrigramIndex(rp.Path, old)
+		if err == nil {
+			err = idx.save(rp.Path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rp.Repo, err)
+			code = 2
+			continue
+		}
+		fmt.Printf("%s: %d files, %d updated\n", rp.Repo, len(idx.Files), updated)
+		if code == 1 {
+			code = 0
+		}
+	}
+	return code
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrigramIndex(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "rgp-trigram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := ioutil.TempDir("", "rgp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=rgp", "-c", "user.email=rgp@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(path, content string) {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	if err := os.Mkdir(filepath.Join(dir, "emptydir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write(".gitignore", "*.log\n")
+	write("a.go", "package a\n\nfunc HelloWorld() {}\n")
+	write("b.txt", "hello there\nKelvin: 273K\n")
+	write("sub/c.go", "// goodbye world\n")
+	write("bin.dat", "hello\x00world")
+	write("debug.log", "hello\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+
+	idx, updated, err := buildTrigramIndex(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range idx.Files {
+		paths = append(paths, f.Path)
+	}
+	if want := []string{"a.go", "b.txt", "bin.dat", "sub/c.go"}; !reflect.DeepEqual(paths, want) || updated != 4 {
+		t.Fatalf("indexed %v (%d updated) want %v", paths, updated, want)
+	}
+	if err := idx.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := func(args ...string) []string {
+		a, err := parseRgArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, id := range idx.candidates(a) {
+			paths = append(paths, idx.Files[id].Path)
+		}
+		return paths
+	}
+	candidateCases := []struct {
+		Args []string
+		Want []string
+	}{
+		{[]string{"-e", "HelloWorld"}, []string{"a.go"}},
+		{[]string{"-i", "-e", "HELLO"}, []string{"a.go", "b.txt"}},
+		{[]string{"-e", "good.*world", "-e", "func"}, []string{"a.go", "sub/c.go"}},
+		{[]string{"-i", "-e", "73k"}, []string{"b.txt"}},
+		{[]string{"-e", "nothing"}, nil},
+		{[]string{"-e", "a."}, []string{"a.go", "b.txt", "bin.dat", "sub/c.go"}},
+		{[]string{"--files-without-match", "-e", "nothing"}, []string{"a.go", "b.txt", "bin.dat", "sub/c.go"}},
+	}
+	for _, tt := range candidateCases {
+		if got := candidates(tt.Args...); !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("candidates(%v) == %v want %v", tt.Args, got, tt.Want)
+		}
+	}
+
+	// The index must find the same lines as searching every file.
+	for _, args := range [][]string{
+		{"-e", "world"},
+		{"-i", "-e", "hello"},
+		{"-g", "*.go", "--files"},
+		{"-g", "!sub", "-e", "world"},
+		{"--files-with-matches", "-e", "o"},
+	} {
+		b := &indexBackend{fallback: &nativeBackend{}}
+		got, gotCode := b.lines(args, []string{dir})
+		want, wantCode := (&nativeBackend{}).lines(args, []string{dir})
+		if b.indexes[dir] == nil {
+			t.Fatalf("%v: index is stale", args)
+		}
+		if !reflect.DeepEqual(got, want) || gotCode != wantCode {
+			t.Errorf("%v: got %v %d want %v %d", args, got, gotCode, want, wantCode)
+		}
+	}
+
+	// Changing a file makes the index stale, and updating it only reads
+	// that file.
+	time.Sleep(10 * time.Millisecond)
+	write("b.txt", "bye\n")
+	if loadTrigramIndex(dir) != nil {
+		t.Fatal("expected index to be stale after changing a file")
+	}
+	old, err := readTrigramIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, updated, err = buildTrigramIndex(dir, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Errorf("updated %d files, want 1", updated)
+	}
+	if got := candidates("-e", "hello"); !reflect.DeepEqual(got, []string{"a.go"}) {
+		t.Errorf("after update candidates == %v", got)
+	}
+	if got := candidates("-e", "bye"); !reflect.DeepEqual(got, []string{"b.txt", "sub/c.go"}) {
+		t.Errorf("after update candidates == %v", got)
+	}
+	if err := idx.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if loadTrigramIndex(dir) == nil {
+		t.Error("expected updated index to be fresh")
+	}
+	if !idx.unchanged(dir) {
+		t.Error("expected updated index to be fresh without running git")
+	}
+
+	// Adding a file is noticed without running git status too.
+	time.Sleep(10 * time.Millisecond)
+	write("sub/d.go", "package sub\n")
+	if idx.unchanged(dir) || loadTrigramIndex(dir) != nil {
+		t.Error("expected index to be stale after adding a file")
+	}
+
+	// So is adding a file to a directory without indexed files.
+	idx, _, err = buildTrigramIndex(dir, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	write("emptydir/new.txt", "needle\n")
+	if idx.unchanged(dir) || loadTrigramIndex(dir) != nil {
+		t.Error("expected index to be stale after adding a file to an empty directory")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// repoDetector recognises the root directory of a repository.
+type repoDetector struct {
+	// VCS is the name of the version control system, as used by the vcs:
+	// atom.
+	VCS string
+
+	// Bare is true if the repositories found have no working tree.
+	Bare bool
+
+	// Detect reports whether dir is the root of a repository.
+	Detect func(dir string) bool
+}
+
+// repoDetectors are tried in order on each directory in SRCPATH. The first
+// match decides the VCS of the repository.
+var repoDetectors = []repoDetector{
+	// jj colocates its repository with git, so is checked first.
+	{VCS: "jj", Detect: hasEntry(".jj")},
+	// .git is a file for worktrees and submodules.
+	{VCS: "git", Detect: hasEntry(".git")},
+	{VCS: "git", Bare: true, Detect: isBareGitRepo},
+	{VCS: "hg", Detect: hasEntry(".hg")},
+	{VCS: "svn", Detect: hasEntry(".svn")},
+	{VCS: "fossil", Detect: hasEntry(".fslckout", "_FOSSIL_")},
+}
+
+// detectRepo returns the detector which recognises dir as a repository.
+func detectRepo(dir string) (repoDetector, bool) {
+	for _, d := range repoDetectors {
+		if d.Detect(dir) {
+			return d, true
+		}
+	}
+	return repoDetector{}, false
+}
+
+// hasEntry returns a detector func which matches directories containing any
+// of names.
+func hasEntry(names ...string) func(string) bool {
+	return func(dir string) bool {
+		for _, name := range names {
+			if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isBareGitRepo reports whether dir is a git directory without a working
+// tree, eg a mirror clone.
+func isBareGitRepo(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	for _, name := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// vcsNames returns the names of the version control systems rgp detects.
+func vcsNames() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, d := range repoDetectors {
+		if !seen[d.VCS] {
+			seen[d.VCS] = true
+			names = append(names, d.VCS)
+		}
+	}
+	return names
+}
+
+func isVCSName(name string) bool {
+	for _, n := range vcsNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// vcsQuery is the vcs: atom. It matches repositories using the named
+// version control system.
+type vcsQuery struct {
+	VCS string
+}
+
+func (q *vcsQuery) String() string {
+	return "vcs:" + q.VCS
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgp-vcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mkdir := func(path string) {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch := func(path string) {
+		mkdir(filepath.Dir(path))
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("gitdir: ../git/worktrees/wt\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir("git/.git")
+	touch("worktree/.git")
+	touch("mirror.git/HEAD")
+	mkdir("mirror.git/objects")
+	mkdir("mirror.git/refs")
+	mkdir("hg/.hg")
+	mkdir("svn/.svn")
+	mkdir("jj/.jj")
+	mkdir("jj/.git")
+	touch("fossil/.fslckout")
+	touch("notrepo/HEAD")
+	mkdir("notrepo/src")
+
+	r, err := walkRepos(context.Background(), dir, walkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, rp := range r.Repos {
+		got[rp.Repo] = rp.VCS
+		if rp.Bare {
+			got[rp.Repo] += " bare"
+		}
+	}
+	want := map[string]string{
+		"git":        "git",
+		"worktree":   "git",
+		"mirror.git": "git bare",
+		"hg":         "hg",
+		"svn":        "svn",
+		"jj":         "jj",
+		"fossil":     "fossil",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestParseVCS(t *testing.T) {
+	q, _, err := parseQuery("foo vcs:HG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.String(), `(and substr:"foo" vcs:hg)`; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if _, _, err := parseQuery("vcs:cvs"); err == nil {
+		t.Error("expected error for unknown vcs")
+	}
+}